@@ -0,0 +1,4 @@
+// Package gophermartpb содержит сгенерированный по gophermart.proto код gRPC API.
+package gophermartpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gophermart.proto
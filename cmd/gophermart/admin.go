@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GET /api/admin/users/:login — информация о пользователе и его балансе (support, admin);
+// GET /api/admin/users/:login/orders — заказы пользователя (support, admin);
+// GET /api/admin/users/:login/withdrawals — списания пользователя (support, admin);
+// GET /api/admin/users/:login/balance — баланс пользователя (support, admin);
+// POST /api/admin/users/:login/disable — блокировка учётной записи (admin);
+// POST /api/admin/users/:login/enable — разблокировка учётной записи (admin);
+// PUT /api/admin/users/:login/role — смена роли пользователя (admin);
+// GET /api/admin/users/:login/adjustments — ручные корректировки баланса пользователя (support, admin);
+// POST /api/admin/users/:login/adjustments — ручное начисление или списание баллов (admin);
+// POST /api/admin/withdrawals/:order/reverse — возврат баллов, списанных в счёт отменённого заказа, целиком или частями (admin);
+// GET /api/admin/apikeys — список сервисных API-ключей (admin);
+// POST /api/admin/apikeys — выпуск сервисного API-ключа (admin);
+// DELETE /api/admin/apikeys/:id — отзыв сервисного API-ключа (admin).
+
+func registerAdminRoutes(router *httprouter.Router, handlerVars *HandlerVars) {
+	staff := []string{RoleSupport, RoleAdmin}
+	router.GET("/api/admin/users/:login", roleRoute(adminUserPage, handlerVars, staff...))
+	router.GET("/api/admin/users/:login/orders", roleRoute(adminUserOrdersPage, handlerVars, staff...))
+	router.GET("/api/admin/users/:login/withdrawals", roleRoute(adminUserWithdrawalsPage, handlerVars, staff...))
+	router.GET("/api/admin/users/:login/balance", roleRoute(adminUserBalancePage, handlerVars, staff...))
+	router.POST("/api/admin/users/:login/disable", roleRoute(adminDisableUserPage, handlerVars, RoleAdmin))
+	router.POST("/api/admin/users/:login/enable", roleRoute(adminEnableUserPage, handlerVars, RoleAdmin))
+	router.PUT("/api/admin/users/:login/role", roleRoute(adminUserRolePage, handlerVars, RoleAdmin))
+	router.GET("/api/admin/users/:login/adjustments", roleRoute(adminUserAdjustmentsPage, handlerVars, staff...))
+	router.POST("/api/admin/users/:login/adjustments", roleRoute(adminAdjustBalancePage, handlerVars, RoleAdmin))
+	router.POST("/api/admin/withdrawals/:order/reverse", roleRoute(adminReverseWithdrawalPage, handlerVars, RoleAdmin))
+	router.GET("/api/admin/apikeys", roleRoute(adminAPIKeysPage, handlerVars, RoleAdmin))
+	router.POST("/api/admin/apikeys", roleRoute(adminCreateAPIKeyPage, handlerVars, RoleAdmin))
+	router.DELETE("/api/admin/apikeys/:id", roleRoute(adminRevokeAPIKeyPage, handlerVars, RoleAdmin))
+}
+
+const (
+	ReasonAccrualCorrection    = "ACCRUAL_CORRECTION"
+	ReasonWithdrawalCorrection = "WITHDRAWAL_CORRECTION"
+	ReasonCompensation         = "COMPENSATION"
+	ReasonOther                = "OTHER"
+)
+
+func isValidReason(reason string) bool {
+	switch reason {
+	case ReasonAccrualCorrection, ReasonWithdrawalCorrection, ReasonCompensation, ReasonOther:
+		return true
+	default:
+		return false
+	}
+}
+
+func isValidScope(scope string) bool {
+	return scope == ScopeOrdersWrite || scope == ScopeWithdrawalsReverse
+}
+
+func isValidRole(role string) bool {
+	return role == RoleCustomer || role == RoleSupport || role == RoleAdmin
+}
+
+// adminTargetUser находит пользователя из параметра :login и пишет ошибку в ответ, если это не удалось.
+func adminTargetUser(w http.ResponseWriter, ps httprouter.Params, db *DBConnection) (*UserInfo, bool) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.GetUserInfo(ps.ByName("login")))
+	if err != nil {
+		if errors.Is(err, ErrLoginNotExist) {
+			writeError(w, errUserNotFound)
+			return nil, false
+		}
+		writeInternalError(w, err)
+		return nil, false
+	}
+	return obj.(*UserInfo), true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	respJSON, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	sugar.Infoln(string(respJSON))
+	w.Write(respJSON)
+}
+
+type AdminUserInfo struct {
+	ID        int     `json:"id"`
+	Login     string  `json:"login"`
+	Role      string  `json:"role"`
+	Disabled  bool    `json:"disabled"`
+	Current   float32 `json:"current"`
+	Withdrawn float32 `json:"withdrawn"`
+}
+
+func adminUserPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetBalanceInfo(userInfo.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	balanceInfo := obj.(*BalanceInfo)
+
+	writeJSON(w, &AdminUserInfo{
+		ID:        userInfo.ID,
+		Login:     userInfo.Login,
+		Role:      userInfo.Role,
+		Disabled:  userInfo.Disabled,
+		Current:   balanceInfo.Current,
+		Withdrawn: balanceInfo.Withdrawn,
+	})
+}
+
+func adminUserOrdersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	filter, err := parseOrdersFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetOrdersInfo(userInfo.ID, filter))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	ordersPage := obj.(*OrdersPage)
+	if len(ordersPage.Orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	setNextPageLink(w, r, ordersPage.Next)
+	writeJSON(w, ordersPage.Orders)
+}
+
+func adminUserWithdrawalsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	filter, err := parseWithdrawalsFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetWithdrawalsInfo(userInfo.ID, filter))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	withdrawalsPage := obj.(*WithdrawalsPage)
+	if withdrawalsPage.TotalCount == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeWithdrawalsPage(w, r, withdrawalsPage)
+}
+
+func adminUserBalancePage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetBalanceInfo(userInfo.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, obj.(*BalanceInfo))
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, ps httprouter.Params, disabled bool) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+	if disabled && userInfo.ID == user.ID {
+		writeError(w, NewAPIError(http.StatusConflict, CodeCannotDisableSelf, "Could not disable own account."))
+		return
+	}
+
+	_, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.SetUserDisabled(userInfo.ID, disabled))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sugar.Infoln("admin", user.ID, "set disabled", disabled, "for user", userInfo.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminDisableUserPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setUserDisabled(w, r, ps, true)
+}
+
+func adminEnableUserPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setUserDisabled(w, r, ps, false)
+}
+
+type RoleInfo struct {
+	Role string `json:"role"`
+}
+
+func adminUserRolePage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var roleInfo RoleInfo
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &roleInfo)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if !isValidRole(roleInfo.Role) {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Unknown role."))
+		return
+	}
+
+	_, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.SetUserRole(ps.ByName("login"), roleInfo.Role))
+	if err != nil {
+		if errors.Is(err, ErrLoginNotExist) {
+			writeError(w, errUserNotFound)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminUserAdjustmentsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetAdjustmentsInfo(userInfo.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	adjustmentsInfo := obj.(*[]AdjustmentInfo)
+	if len(*adjustmentsInfo) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, adjustmentsInfo)
+}
+
+// AdjustmentRequest описывает ручную корректировку: положительная сумма начисляется, отрицательная списывается.
+type AdjustmentRequest struct {
+	Sum     float32 `json:"sum"`
+	Reason  string  `json:"reason"`
+	Comment string  `json:"comment"`
+}
+
+func adminAdjustBalancePage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var adjustment AdjustmentRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &adjustment)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if adjustment.Sum == 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Adjustment sum must not be zero."))
+		return
+	}
+	if !isValidReason(adjustment.Reason) {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Unknown reason code."))
+		return
+	}
+	if strings.TrimSpace(adjustment.Comment) == "" {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Comment is required."))
+		return
+	}
+
+	userInfo, ok := adminTargetUser(w, ps, handlerVars.db)
+	if !ok {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.AdjustBalance(userInfo.ID, user.ID, adjustment.Sum, adjustment.Reason, adjustment.Comment,
+			handlerVars.pointsExpiresAt(time.Now())))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, NewAPIError(http.StatusConflict, CodeInsufficientFunds, "Not enough balance."))
+		return
+	}
+	sugar.Infoln("admin", user.ID, "adjusted balance of user", userInfo.ID, "by", adjustment.Sum, adjustment.Reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminAPIKeysPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetAPIKeys())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	keys := obj.(*[]APIKeyInfo)
+	if len(*keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIKeyAnswer struct {
+	ID  int    `json:"id"`
+	Key string `json:"key"`
+}
+
+func adminCreateAPIKeyPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var keyRequest APIKeyRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &keyRequest)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if strings.TrimSpace(keyRequest.Name) == "" {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Key name is required."))
+		return
+	}
+	if len(keyRequest.Scopes) == 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "At least one scope is required."))
+		return
+	}
+	for _, scope := range keyRequest.Scopes {
+		if !isValidScope(scope) {
+			writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Unknown scope: "+scope))
+			return
+		}
+	}
+
+	key, err := GenerateAPIKey()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.CreateAPIKey(keyRequest.Name, keyRequest.Scopes, user.ID, HashToken(key)))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sugar.Infoln("admin", user.ID, "created api key", obj.(int), keyRequest.Scopes)
+
+	respJSON, err := json.Marshal(&APIKeyAnswer{ID: obj.(int), Key: key})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respJSON)
+}
+
+func adminRevokeAPIKeyPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	keyID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect api key id."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.RevokeAPIKey(keyID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Api key not found."))
+		return
+	}
+	sugar.Infoln("admin", user.ID, "revoked api key", keyID)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+	// Часовые пояса встроены в бинарник: в контейнере может не быть системной базы tzdata.
+	_ "time/tzdata"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	dateLayout         = "2006-01-02"
+	defaultHistoryDays = 30
+	maxHistoryDays     = 366
+	defaultHistoryTZ   = "UTC"
+)
+
+// BalanceHistoryQuery — параметры GET /api/user/balance/history. Дни From и To включаются в ряд,
+// их границы считаются в часовом поясе Location.
+type BalanceHistoryQuery struct {
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+}
+
+// parseBalanceHistoryQuery разбирает from, to (YYYY-MM-DD) и tz (имя из базы IANA).
+// Без параметров возвращаются последние defaultHistoryDays дней по UTC.
+func parseBalanceHistoryQuery(query url.Values, now time.Time) (*BalanceHistoryQuery, error) {
+	tz := query.Get("tz")
+	if tz == "" {
+		tz = defaultHistoryTZ
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New("tz must be an IANA time zone name")
+	}
+	hq := BalanceHistoryQuery{Location: loc}
+
+	now = now.In(loc)
+	hq.To = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if v := query.Get("to"); v != "" {
+		hq.To, err = time.ParseInLocation(dateLayout, v, loc)
+		if err != nil {
+			return nil, errors.New("to must be a date in YYYY-MM-DD format")
+		}
+	}
+	hq.From = hq.To.AddDate(0, 0, 1-defaultHistoryDays)
+	if v := query.Get("from"); v != "" {
+		hq.From, err = time.ParseInLocation(dateLayout, v, loc)
+		if err != nil {
+			return nil, errors.New("from must be a date in YYYY-MM-DD format")
+		}
+	}
+	if hq.From.After(hq.To) {
+		return nil, errors.New("from must not be after to")
+	}
+	if hq.From.AddDate(0, 0, maxHistoryDays).Before(hq.To.AddDate(0, 0, 1)) {
+		return nil, errors.New("period must not be longer than 366 days")
+	}
+	return &hq, nil
+}
+
+type BalanceDay struct {
+	Date           string  `json:"date"`
+	OpeningBalance float64 `json:"opening_balance"`
+	PointsTotals
+	ClosingBalance float64 `json:"closing_balance"`
+}
+
+type BalanceHistory struct {
+	TimeZone string       `json:"time_zone"`
+	Days     []BalanceDay `json:"days"`
+}
+
+// balanceHistoryBuilder раскладывает операции по дням. Начало следующего дня берётся через time.Date,
+// поэтому дни с переходом на летнее время короче или длиннее 24 часов.
+type balanceHistoryBuilder struct {
+	loc     *time.Location
+	history BalanceHistory
+	dayEnd  time.Time
+	balance float64
+	day     BalanceDay
+}
+
+func (b *balanceHistoryBuilder) startDay(start time.Time) {
+	b.day = BalanceDay{Date: start.Format(dateLayout), OpeningBalance: roundPoints(b.balance)}
+	b.dayEnd = time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, b.loc)
+}
+
+func (b *balanceHistoryBuilder) closeDay() {
+	b.day.round()
+	b.day.ClosingBalance = roundPoints(b.balance)
+	b.history.Days = append(b.history.Days, b.day)
+	b.startDay(b.dayEnd)
+}
+
+func (b *balanceHistoryBuilder) add(e *StatementEntry) error {
+	for !e.At.Before(b.dayEnd) {
+		b.closeDay()
+	}
+	b.balance += e.Amount
+	b.day.accumulate(e)
+	return nil
+}
+
+func balanceHistoryPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	hq, err := parseBalanceHistoryQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	// ETag не выставляется: без параметра to ряд сдвигается с началом нового дня, даже если данные не менялись.
+	end := time.Date(hq.To.Year(), hq.To.Month(), hq.To.Day()+1, 0, 0, 0, 0, hq.Location)
+	// Первый день заводится до чтения операций: без него dayEnd нулевой и ряд ниже не закончится.
+	b := balanceHistoryBuilder{loc: hq.Location, history: BalanceHistory{TimeZone: hq.Location.String()}}
+	b.startDay(hq.From)
+	opening := func(balance float64) error {
+		b.balance = balance
+		b.day.OpeningBalance = roundPoints(balance)
+		return nil
+	}
+	err = handlerVars.db.StreamStatement(r.Context(), user.ID, hq.From, end, opening, b.add)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	for !b.dayEnd.After(end) {
+		b.closeDay()
+	}
+	writeJSON(w, &b.history)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBalanceHistoryQuery(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// В Нью-Йорке в этот момент ещё 14 июня.
+	now := time.Date(2024, 6, 15, 1, 0, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day int, loc *time.Location) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+	tests := []struct {
+		name     string
+		query    string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{name: "defaults", query: "",
+			wantFrom: date(2024, 5, 17, time.UTC), wantTo: date(2024, 6, 15, time.UTC)},
+		{name: "time zone shifts today", query: "tz=America/New_York",
+			wantFrom: date(2024, 5, 16, newYork), wantTo: date(2024, 6, 14, newYork)},
+		{name: "explicit period", query: "from=2024-01-01&to=2024-01-31",
+			wantFrom: date(2024, 1, 1, time.UTC), wantTo: date(2024, 1, 31, time.UTC)},
+		{name: "to only", query: "to=2024-03-10",
+			wantFrom: date(2024, 2, 10, time.UTC), wantTo: date(2024, 3, 10, time.UTC)},
+		{name: "single day", query: "from=2024-01-01&to=2024-01-01",
+			wantFrom: date(2024, 1, 1, time.UTC), wantTo: date(2024, 1, 1, time.UTC)},
+		{name: "longest period", query: "from=2023-06-15&to=2024-06-14",
+			wantFrom: date(2023, 6, 15, time.UTC), wantTo: date(2024, 6, 14, time.UTC)},
+		{name: "period too long", query: "from=2023-06-14&to=2024-06-14", wantErr: true},
+		{name: "from after to", query: "from=2024-02-01&to=2024-01-31", wantErr: true},
+		{name: "bad from", query: "from=2024-01-01T00:00:00Z", wantErr: true},
+		{name: "bad to", query: "to=31.01.2024", wantErr: true},
+		{name: "unknown time zone", query: "tz=Mars/Olympus", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseBalanceHistoryQuery(query, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBalanceHistoryQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !got.From.Equal(tt.wantFrom) || !got.To.Equal(tt.wantTo) {
+				t.Errorf("parseBalanceHistoryQuery() = %v..%v, want %v..%v", got.From, got.To, tt.wantFrom, tt.wantTo)
+			}
+			if got.Location.String() != tt.wantTo.Location().String() {
+				t.Errorf("parseBalanceHistoryQuery() location = %s, want %s", got.Location, tt.wantTo.Location())
+			}
+		})
+	}
+}
+
+func TestBalanceHistoryBuilderDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 31 марта 2024 года в Берлине длится 23 часа.
+	from := time.Date(2024, 3, 30, 0, 0, 0, 0, berlin)
+	end := time.Date(2024, 4, 2, 0, 0, 0, 0, berlin)
+	entries := []StatementEntry{
+		{Type: StatementAccrual, Amount: 5, At: time.Date(2024, 3, 30, 12, 0, 0, 0, berlin)},
+		{Type: StatementAccrual, Amount: 1, At: time.Date(2024, 3, 31, 23, 30, 0, 0, berlin)},
+		{Type: StatementWithdrawal, Amount: -2, At: time.Date(2024, 4, 1, 0, 0, 0, 0, berlin)},
+	}
+
+	b := balanceHistoryBuilder{loc: berlin}
+	b.startDay(from)
+	b.balance = 10
+	b.day.OpeningBalance = 10
+	for i := range entries {
+		if err := b.add(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for !b.dayEnd.After(end) {
+		b.closeDay()
+	}
+
+	want := []BalanceDay{
+		{Date: "2024-03-30", OpeningBalance: 10, PointsTotals: PointsTotals{Accrued: 5}, ClosingBalance: 15},
+		{Date: "2024-03-31", OpeningBalance: 15, PointsTotals: PointsTotals{Accrued: 1}, ClosingBalance: 16},
+		{Date: "2024-04-01", OpeningBalance: 16, PointsTotals: PointsTotals{Withdrawn: 2}, ClosingBalance: 14},
+	}
+	if !reflect.DeepEqual(b.history.Days, want) {
+		t.Errorf("days = %+v, want %+v", b.history.Days, want)
+	}
+}
+
+func TestBalanceHistoryBuilderNoEntries(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	b := balanceHistoryBuilder{loc: time.UTC}
+	b.startDay(from)
+	for !b.dayEnd.After(end) {
+		b.closeDay()
+	}
+	if len(b.history.Days) != 2 || b.history.Days[0].Date != "2024-01-01" || b.history.Days[1].Date != "2024-01-02" {
+		t.Errorf("days = %+v, want 2024-01-01 and 2024-01-02", b.history.Days)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GET /api/admin/campaigns — список акций с израсходованным бюджетом и числом бонусов (support, admin);
+// POST /api/admin/campaigns — создание акции: период, множитель или фиксированный бонус, уровни, сегмент и бюджет (admin);
+// GET /api/admin/campaigns/:id — акция и итоги по её бонусам (support, admin);
+// DELETE /api/admin/campaigns/:id — остановка акции (admin).
+
+func registerCampaignRoutes(router *httprouter.Router, handlerVars *HandlerVars) {
+	staff := []string{RoleSupport, RoleAdmin}
+	router.GET("/api/admin/campaigns", roleRoute(adminCampaignsPage, handlerVars, staff...))
+	router.POST("/api/admin/campaigns", roleRoute(adminCreateCampaignPage, handlerVars, RoleAdmin))
+	router.GET("/api/admin/campaigns/:id", roleRoute(adminCampaignPage, handlerVars, staff...))
+	router.DELETE("/api/admin/campaigns/:id", roleRoute(adminDisableCampaignPage, handlerVars, RoleAdmin))
+}
+
+type BonusEvent struct {
+	Order    string  `json:"order"`
+	Campaign string  `json:"campaign"`
+	Sum      float64 `json:"sum"`
+}
+
+// CampaignRequest — новая акция. Задаётся либо Multiplier больше 1, либо фиксированный Bonus за заказ.
+// Пустые Tiers и Logins означают, что акция действует для всех.
+type CampaignRequest struct {
+	Name       string   `json:"name"`
+	StartsAt   string   `json:"starts_at"`
+	EndsAt     string   `json:"ends_at"`
+	Multiplier float64  `json:"multiplier"`
+	Bonus      float64  `json:"bonus"`
+	Tiers      []string `json:"tiers"`
+	Logins     []string `json:"logins"`
+	Budget     *float64 `json:"budget"`
+}
+
+// bonusFor считает бонус сверх начисления accrual с учётом остатка бюджета.
+func (c *Campaign) bonusFor(accrual float64) float64 {
+	bonus := c.Bonus
+	if c.Multiplier > 1 {
+		bonus += accrual * (c.Multiplier - 1)
+	}
+	if c.Budget != nil && bonus > *c.Budget-c.Spent {
+		bonus = *c.Budget - c.Spent
+	}
+	return roundPoints(bonus)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCampaigns начисляет бонусы акций за заказ, только что перешедший в PROCESSED.
+func applyCampaigns(handlerVars *HandlerVars, loginID int, orderNum string, accrual float32, tier string) {
+	now := time.Now().UTC()
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.ApplyCampaigns(loginID, orderNum, accrual, tier, now, handlerVars.pointsExpiresAt(now)))
+	if err != nil {
+		sugar.Errorln("Could not apply campaigns to order", orderNum, err.Error())
+		return
+	}
+	for _, bonus := range obj.([]CampaignBonus) {
+		sugar.Infoln("campaign", bonus.CampaignID, "credited", bonus.Amount, "for order", orderNum)
+		publishEvent(handlerVars, loginID, EventBonusCredited,
+			&BonusEvent{Order: orderNum, Campaign: bonus.Campaign, Sum: bonus.Amount})
+	}
+}
+
+// validateCampaign проверяет запрос и возвращает границы периода акции.
+func validateCampaign(c *CampaignRequest, tiers *TierPolicy) (time.Time, time.Time, *APIError) {
+	var startsAt, endsAt time.Time
+	invalid := func(msg string) (time.Time, time.Time, *APIError) {
+		return startsAt, endsAt, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, msg)
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return invalid("Campaign name is required.")
+	}
+	var err error
+	startsAt, err = time.Parse(time.RFC3339, c.StartsAt)
+	if err != nil {
+		return invalid("starts_at must be an RFC3339 timestamp.")
+	}
+	endsAt, err = time.Parse(time.RFC3339, c.EndsAt)
+	if err != nil {
+		return invalid("ends_at must be an RFC3339 timestamp.")
+	}
+	if !startsAt.Before(endsAt) {
+		return invalid("starts_at must be before ends_at.")
+	}
+	if (c.Multiplier > 1) == (c.Bonus > 0) {
+		return invalid("Exactly one of multiplier greater than 1 or positive bonus is required.")
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = 1
+	}
+	if c.Multiplier < 1 || c.Bonus < 0 {
+		return invalid("Campaign must not reduce accruals.")
+	}
+	if c.Budget != nil && *c.Budget <= 0 {
+		return invalid("budget must be positive.")
+	}
+	for _, tier := range c.Tiers {
+		found := false
+		for _, t := range tiers.Tiers {
+			found = found || t.Name == tier
+		}
+		if !found {
+			return invalid("Unknown tier: " + tier)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, login := range c.Logins {
+		if seen[login] {
+			return invalid("Login is listed twice: " + login)
+		}
+		seen[login] = true
+	}
+	return startsAt.UTC(), endsAt.UTC(), nil
+}
+
+func adminCampaignsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetCampaigns())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	campaigns := obj.([]Campaign)
+	if len(campaigns) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, campaigns)
+}
+
+func adminCreateCampaignPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var campaign CampaignRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &campaign)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	startsAt, endsAt, apiErr := validateCampaign(&campaign, handlerVars.Tiers)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.CreateCampaign(&campaign, startsAt, endsAt, user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	campaignID := obj.(int)
+	if campaignID == -1 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeUserNotFound, "Some logins of the segment do not exist."))
+		return
+	}
+	sugar.Infoln("admin", user.ID, "created campaign", campaignID)
+
+	obj, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetCampaign(campaignID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	respJSON, err := json.Marshal(obj.(*Campaign))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respJSON)
+}
+
+func adminCampaignPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	campaignID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect campaign id."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetCampaign(campaignID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	campaign := obj.(*Campaign)
+	if campaign == nil {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Campaign not found."))
+		return
+	}
+	writeJSON(w, campaign)
+}
+
+func adminDisableCampaignPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	campaignID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect campaign id."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.DisableCampaign(campaignID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Campaign not found."))
+		return
+	}
+	sugar.Infoln("admin", user.ID, "disabled campaign", campaignID)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxDecompressedBodySize ограничивает размер тела запроса после распаковки.
+	maxDecompressedBodySize = 1 << 20
+	// minCompressSize — ответы меньше этого размера отдаются без сжатия.
+	minCompressSize = 1024
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+	encodingZstd    = "zstd"
+)
+
+// supportedEncodings перечислены в порядке предпочтения сервера при равных q.
+var supportedEncodings = []string{encodingZstd, encodingGzip, encodingDeflate}
+
+var (
+	errRequestTooLarge = NewAPIError(http.StatusRequestEntityTooLarge, CodeRequestTooLarge,
+		"Decompressed request body is too large.")
+	errUnsupportedContentEncoding = NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedContentEncoding,
+		"Request content encoding is not supported, use gzip, deflate or zstd.")
+	errInvalidCompressedBody = NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Request body could not be decompressed.")
+)
+
+// CompressionMiddleware распаковывает тело запроса по Content-Encoding и сжимает ответ
+// алгоритмом, выбранным по Accept-Encoding.
+func CompressionMiddleware(next httprouter.Handle) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !decompressRequest(w, r) {
+			return
+		}
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next(w, r, ps)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.Close()
+		next(cw, r, ps)
+	})
+}
+
+// decompressRequest заменяет сжатое тело запроса распакованным. Тело читается целиком,
+// чтобы повреждённые и слишком большие данные отклонялись до обработчика. Возвращает false, если ответ уже отправлен.
+func decompressRequest(w http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+
+	var reader io.Reader
+	switch encoding {
+	case encodingGzip, "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, errInvalidCompressedBody)
+			return false
+		}
+		defer gz.Close()
+		reader = gz
+	case encodingDeflate:
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			writeError(w, errInvalidCompressedBody)
+			return false
+		}
+		defer zr.Close()
+		reader = zr
+	case encodingZstd:
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecompressedBodySize))
+		if err != nil {
+			writeInternalError(w, err)
+			return false
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		writeError(w, errUnsupportedContentEncoding)
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxDecompressedBodySize+1))
+	if err != nil {
+		writeError(w, errInvalidCompressedBody)
+		return false
+	}
+	if len(body) > maxDecompressedBodySize {
+		writeError(w, errRequestTooLarge)
+		return false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+// negotiateEncoding выбирает кодировку с наибольшим q из Accept-Encoding. Пустая строка — без сжатия.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+		if name == "x-gzip" {
+			name = encodingGzip
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter копит начало ответа и включает сжатие, только когда тело набрало minCompressSize.
+// Ответы без тела, ответы с ошибками и маленькие тела уходят как есть.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int
+	buf         []byte
+	compressor  io.WriteCloser
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.passthrough || cw.compressor != nil {
+		return
+	}
+	cw.status = statusCode
+	if !bodyAllowsCompression(statusCode) {
+		cw.startPassthrough()
+	}
+}
+
+func bodyAllowsCompression(status int) bool {
+	return status >= http.StatusOK && status < http.StatusBadRequest &&
+		status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.passthrough {
+		return cw.ResponseWriter.Write(b)
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	if cw.Header().Get("Content-Encoding") != "" {
+		cw.startPassthrough()
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= minCompressSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (cw *compressWriter) startPassthrough() {
+	cw.passthrough = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) startCompression() error {
+	var err error
+	switch cw.encoding {
+	case encodingGzip:
+		cw.compressor, err = gzip.NewWriterLevel(cw.ResponseWriter, gzip.BestSpeed)
+	case encodingDeflate:
+		cw.compressor, err = zlib.NewWriterLevel(cw.ResponseWriter, zlib.BestSpeed)
+	case encodingZstd:
+		cw.compressor, err = zstd.NewWriter(cw.ResponseWriter,
+			zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	}
+	if err != nil {
+		cw.startPassthrough()
+		return err
+	}
+
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	// Сжатое представление отличается от несжатого, поэтому сильный ETag тоже должен отличаться.
+	if etag := header.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		header.Set("ETag", etag[:len(etag)-1]+"-"+cw.encoding+`"`)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err = cw.compressor.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.passthrough && cw.compressor == nil {
+		cw.startPassthrough()
+	}
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close дописывает накопленное тело: сжатое, если сжатие уже началось, иначе как есть.
+func (cw *compressWriter) Close() error {
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+	if !cw.passthrough {
+		cw.startPassthrough()
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "empty header", acceptEncoding: "", want: ""},
+		{name: "identity only", acceptEncoding: "identity", want: ""},
+		{name: "single gzip", acceptEncoding: "gzip", want: encodingGzip},
+		{name: "x-gzip alias", acceptEncoding: "x-gzip", want: encodingGzip},
+		{name: "case insensitive", acceptEncoding: "GZIP", want: encodingGzip},
+		{name: "server preference on equal q", acceptEncoding: "deflate, gzip, zstd", want: encodingZstd},
+		{name: "highest q wins", acceptEncoding: "zstd;q=0.5, gzip;q=0.9, deflate;q=0.1", want: encodingGzip},
+		{name: "spaces around params", acceptEncoding: "gzip ; q=0.2 , deflate ; q=0.8", want: encodingDeflate},
+		{name: "q zero disables", acceptEncoding: "gzip;q=0", want: ""},
+		{name: "invalid q treated as zero", acceptEncoding: "gzip;q=abc, deflate", want: encodingDeflate},
+		{name: "wildcard", acceptEncoding: "*", want: encodingZstd},
+		{name: "wildcard with exclusion", acceptEncoding: "*;q=0.5, zstd;q=0", want: encodingGzip},
+		{name: "explicit beats wildcard", acceptEncoding: "*;q=0.1, deflate;q=0.3", want: encodingDeflate},
+		{name: "wildcard disabled", acceptEncoding: "*;q=0", want: ""},
+		{name: "unsupported only", acceptEncoding: "br, compress", want: ""},
+		{name: "unsupported mixed", acceptEncoding: "br;q=1.0, gzip;q=0.5", want: encodingGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressionMiddlewareRoundTrip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(`{"order":"12345678903"}`))
+	gz.Close()
+
+	response := strings.Repeat("a", minCompressSize*2)
+	var received string
+	handler := CompressionMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Write([]byte(response))
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/", &compressed)
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+
+	if received != `{"order":"12345678903"}` {
+		t.Errorf("handler received %q", received)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != encodingGzip {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != response {
+		t.Errorf("decompressed response has %d bytes, want %d", len(body), len(response))
+	}
+}
+
+func TestCompressionMiddlewareRejectsBadBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		want     int
+	}{
+		{name: "corrupt gzip", encoding: "gzip", want: http.StatusBadRequest},
+		{name: "unsupported encoding", encoding: "br", want: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := CompressionMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				called = true
+			})
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not compressed"))
+			r.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			handler(w, r, nil)
+			if called {
+				t.Error("handler called for a body that could not be decompressed")
+			}
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
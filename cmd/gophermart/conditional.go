@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+// checkNotModified выставляет ETag и Last-Modified по версии данных пользователя и отвечает 304,
+// если копия клиента актуальна. Возвращает true, если ответ уже отправлен.
+//
+// Версия читается до основного запроса: если данные изменятся между ними, клиент получит свежее тело
+// со старым ETag и просто перезапросит его в следующий раз, но устаревшие данные не будут считаться актуальными.
+func checkNotModified(w http.ResponseWriter, r *http.Request, handlerVars *HandlerVars, loginID int) bool {
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetDataVersion(loginID))
+	if err != nil {
+		writeInternalError(w, err)
+		return true
+	}
+	version := obj.(*DataVersion)
+
+	etag := representationETag(r, loginID, version.Version)
+	lastModified := version.ChangedAt.UTC().Truncate(time.Second)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// representationETag различает не только версию данных, но и представление:
+// путь, параметры запроса и Accept влияют на тело ответа.
+func representationETag(r *http.Request, loginID int, version int64) string {
+	h := fnv.New32a()
+	h.Write([]byte(r.URL.Path + "?" + r.URL.RawQuery + "\n" + r.Header.Get("Accept")))
+	return fmt.Sprintf(`"%d-%d-%08x"`, loginID, version, h.Sum32())
+}
+
+// notModified следует RFC 9110: при наличии If-None-Match заголовок If-Modified-Since не учитывается.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || stripEncodingSuffix(strings.TrimPrefix(candidate, "W/")) == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(t)
+	}
+	return false
+}
+
+// stripEncodingSuffix убирает суффикс, который CompressionMiddleware добавляет к ETag сжатого ответа.
+func stripEncodingSuffix(etag string) string {
+	for _, encoding := range supportedEncodings {
+		suffix := "-" + encoding + `"`
+		if strings.HasSuffix(etag, suffix) {
+			return strings.TrimSuffix(etag, suffix) + `"`
+		}
+	}
+	return etag
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Коды ошибок API. Клиенты различают ошибки по коду, текст сообщения может меняться.
+const (
+	CodeInvalidRequest             = "INVALID_REQUEST"
+	CodeUnsupportedContentType     = "UNSUPPORTED_CONTENT_TYPE"
+	CodeUnsupportedContentEncoding = "UNSUPPORTED_CONTENT_ENCODING"
+	CodeRequestTooLarge            = "REQUEST_TOO_LARGE"
+	CodeValidationFailed           = "VALIDATION_FAILED"
+	CodeUnauthorized               = "UNAUTHORIZED"
+	CodeInvalidCredentials         = "INVALID_CREDENTIALS"
+	CodeSecondFactorRequired       = "SECOND_FACTOR_REQUIRED"
+	CodeInvalidSecondFactor        = "INVALID_SECOND_FACTOR"
+	CodeLoginChallengeExpired      = "LOGIN_CHALLENGE_EXPIRED"
+	CodeSecondFactorEnabled        = "SECOND_FACTOR_ALREADY_ENABLED"
+	CodeSecondFactorNotEnrolled    = "SECOND_FACTOR_NOT_ENROLLED"
+	CodeSecondFactorLocked         = "SECOND_FACTOR_LOCKED"
+	CodeAccountDisabled            = "ACCOUNT_DISABLED"
+	CodeForbidden                  = "FORBIDDEN"
+	CodeLoginTaken                 = "LOGIN_TAKEN"
+	CodeInvalidReferralCode        = "INVALID_REFERRAL_CODE"
+	CodeUserNotFound               = "USER_NOT_FOUND"
+	CodeCannotDisableSelf          = "CANNOT_DISABLE_SELF"
+	CodeInvalidOrderNumber         = "INVALID_ORDER_NUMBER"
+	CodeOrderOwnedByAnotherUser    = "ORDER_OWNED_BY_ANOTHER_USER"
+	CodeOrderNotFound              = "ORDER_NOT_FOUND"
+	CodeTooManyOrders              = "TOO_MANY_ORDERS"
+	CodeInsufficientFunds          = "INSUFFICIENT_FUNDS"
+	CodeTransferLimitExceeded      = "TRANSFER_LIMIT_EXCEEDED"
+	CodeTransferNotPending         = "TRANSFER_NOT_PENDING"
+	CodeAlreadyReversed            = "ALREADY_REVERSED"
+	CodeHoldNotActive              = "HOLD_NOT_ACTIVE"
+	CodeOrderAlreadyUsed           = "ORDER_ALREADY_USED"
+	CodeAccrualUnavailable         = "ACCRUAL_UNAVAILABLE"
+	CodeNotFound                   = "NOT_FOUND"
+	CodeMethodNotAllowed           = "METHOD_NOT_ALLOWED"
+	CodeInternal                   = "INTERNAL_ERROR"
+)
+
+// APIError — ошибка, которую можно показать клиенту: HTTP-статус, код и сообщение без внутренних подробностей.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func NewAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+var (
+	errInternal             = NewAPIError(http.StatusInternalServerError, CodeInternal, "Internal server error.")
+	errUnauthorized         = NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "Unauthorized.")
+	errForbidden            = NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden.")
+	errAccountDisabled      = NewAPIError(http.StatusForbidden, CodeAccountDisabled, "Account is disabled.")
+	errNotJSON              = NewAPIError(http.StatusBadRequest, CodeUnsupportedContentType, "Request content type is not json.")
+	errInvalidJSON          = NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Request body is not valid json.")
+	errInvalidOrderNumber   = NewAPIError(http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "Incorrect order number format.")
+	errUserNotFound         = NewAPIError(http.StatusNotFound, CodeUserNotFound, "Login does not exist.")
+	errInsufficientFunds    = NewAPIError(http.StatusPaymentRequired, CodeInsufficientFunds, "Not enough balance.")
+	errSecondFactorEnabled  = NewAPIError(http.StatusConflict, CodeSecondFactorEnabled, "Second factor is already enabled.")
+	errInvalidSecondFactor  = NewAPIError(http.StatusUnprocessableEntity, CodeInvalidSecondFactor, "Wrong code.")
+	errAccrualUnavailable   = NewAPIError(http.StatusBadGateway, CodeAccrualUnavailable, "Accrual system is unavailable.")
+	errStreamingUnsupported = NewAPIError(http.StatusInternalServerError, CodeInternal, "Streaming is not supported.")
+)
+
+// ErrorResponse — тело любого ответа с ошибкой.
+type ErrorResponse struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id"`
+	Details   []ValidationError `json:"details,omitempty"`
+}
+
+func newErrorResponse(w http.ResponseWriter, apiErr *APIError) ErrorResponse {
+	return ErrorResponse{Code: apiErr.Code, Message: apiErr.Message, RequestID: w.Header().Get(requestIDHeader)}
+}
+
+func writeErrorBody(w http.ResponseWriter, status int, body interface{}) {
+	respJSON, err := json.Marshal(body)
+	if err != nil {
+		sugar.Errorln(err.Error())
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(respJSON)
+}
+
+func writeError(w http.ResponseWriter, apiErr *APIError) {
+	writeErrorBody(w, apiErr.Status, newErrorResponse(w, apiErr))
+}
+
+// writeInternalError пишет err в лог вместе с идентификатором запроса, а клиенту отдаёт только INTERNAL_ERROR.
+func writeInternalError(w http.ResponseWriter, err error) {
+	sugar.Errorw(err.Error(), "request_id", w.Header().Get(requestIDHeader))
+	writeError(w, errInternal)
+}
+
+// respondError отвечает на ошибку общей с gRPC API функции вроде submitOrder или withdrawBalance.
+// Клиент видит только ошибки типа *APIError, остальные считаются внутренними.
+func respondError(w http.ResponseWriter, err error) {
+	if apiErr, ok := err.(*APIError); ok {
+		writeError(w, apiErr)
+		return
+	}
+	writeInternalError(w, err)
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// Идентификатор от клиента принимается, только если его безопасно писать в лог и заголовок ответа.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware выставляет заголовок X-Request-ID ответа: берёт его из запроса или генерирует новый.
+// Должен быть внешним, чтобы идентификатор видели логирование и ответы с ошибками.
+func RequestIDMiddleware(next httprouter.Handle) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			var err error
+			requestID, err = GenerateRandomToken()
+			if err != nil {
+				sugar.Errorln(err.Error())
+			}
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next(w, r, ps)
+	})
+}
+
+// errorHandler отвечает apiErr на запросы, для которых в роутере нет обработчика.
+func errorHandler(apiErr *APIError) http.Handler {
+	handle := RequestIDMiddleware(LoggingMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		writeError(w, apiErr)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, nil)
+	})
+}
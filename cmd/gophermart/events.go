@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	EventOrderStatusChanged  = "order-status-changed"
+	EventPointsCredited      = "points-credited"
+	EventWithdrawalCompleted = "withdrawal-completed"
+	EventWithdrawalReversed  = "withdrawal-reversed"
+	EventPointsExpired       = "points-expired"
+	EventTierChanged         = "tier-changed"
+	EventBonusCredited       = "bonus-credited"
+	EventReferralCredited    = "referral-bonus-credited"
+	EventTransferCompleted   = "transfer-completed"
+	EventPointsHeld          = "points-held"
+	EventHoldReleased        = "hold-released"
+)
+
+const (
+	eventsHeartbeatInterval = 15 * time.Second
+	eventsSubscriberBuffer  = 16
+	// eventsReplayBatch — сколько пропущенных событий читается из базы за один запрос.
+	eventsReplayBatch = 1000
+)
+
+type Event struct {
+	ID      int
+	LoginID int
+	Type    string
+	Data    string
+}
+
+// EventBroker раздаёт события подключённым SSE-клиентам пользователя.
+// Сами события хранятся в базе, поэтому отставший клиент отключается и догоняет по Last-Event-ID.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan *Event]struct{}
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[int]map[chan *Event]struct{})}
+}
+
+func (b *EventBroker) Subscribe(loginID int) chan *Event {
+	ch := make(chan *Event, eventsSubscriberBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[loginID] == nil {
+		b.subscribers[loginID] = make(map[chan *Event]struct{})
+	}
+	b.subscribers[loginID][ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(loginID int, ch chan *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(loginID, ch)
+}
+
+func (b *EventBroker) remove(loginID int, ch chan *Event) {
+	if _, ok := b.subscribers[loginID][ch]; !ok {
+		return
+	}
+	delete(b.subscribers[loginID], ch)
+	if len(b.subscribers[loginID]) == 0 {
+		delete(b.subscribers, loginID)
+	}
+	close(ch)
+}
+
+func (b *EventBroker) Publish(event *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.LoginID] {
+		select {
+		case ch <- event:
+		default:
+			b.remove(event.LoginID, ch)
+		}
+	}
+}
+
+type OrderStatusEvent struct {
+	Order   string  `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float32 `json:"accrual"`
+}
+
+type PointsEvent struct {
+	Order string  `json:"order"`
+	Sum   float32 `json:"sum"`
+}
+
+// publishEvent сохраняет событие пользователя, рассылает его SSE-подписчикам и ставит в очередь вебхуков.
+// Ошибка только логируется: событие не должно ломать операцию, которая его породила.
+func publishEvent(handlerVars *HandlerVars, loginID int, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		sugar.Errorln(err.Error())
+		return
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.InsertEvent(loginID, eventType, string(data)))
+	if err != nil {
+		sugar.Errorln("Could not save event. " + err.Error())
+		return
+	}
+	handlerVars.events.Publish(&Event{ID: obj.(int), LoginID: loginID, Type: eventType, Data: string(data)})
+	enqueueWebhooks(handlerVars, loginID, eventType, payload, string(data))
+}
+
+// replayEvents передаёт в send все события пользователя после afterID партиями по eventsReplayBatch,
+// пока очередная партия не окажется неполной: разрыв любой длины досылается целиком.
+// Возвращает id последнего переданного события.
+func replayEvents(db *DBConnection, loginID, afterID int, send func(event *Event) error) (int, error) {
+	for {
+		obj, err := Retrypg(pgerrcode.ConnectionException, db.GetEventsAfter(loginID, afterID, eventsReplayBatch))
+		if err != nil {
+			return afterID, err
+		}
+		events := *obj.(*[]Event)
+		for i := range events {
+			if err := send(&events[i]); err != nil {
+				return afterID, err
+			}
+			afterID = events[i].ID
+		}
+		if len(events) < eventsReplayBatch {
+			return afterID, nil
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event *Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+func eventsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errStreamingUnsupported)
+		return
+	}
+
+	lastID := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 {
+			writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect Last-Event-ID."))
+			return
+		}
+		lastID = id
+	}
+
+	// Подписываемся до чтения истории, чтобы не потерять события между запросом и подпиской.
+	ch := handlerVars.events.Subscribe(user.ID)
+	defer handlerVars.events.Unsubscribe(user.ID, ch)
+
+	// Заголовки отправляются вместе с первым событием истории: пока ничего не записано, об ошибке базы
+	// ещё можно ответить кодом 500.
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+	if lastID > 0 {
+		var writeErr error
+		var err error
+		lastID, err = replayEvents(handlerVars.db, user.ID, lastID, func(event *Event) error {
+			if !started {
+				start()
+			}
+			writeErr = writeEvent(w, event)
+			return writeErr
+		})
+		if err != nil {
+			if !started {
+				writeInternalError(w, err)
+			} else if err != writeErr {
+				// Клиент переподключится с Last-Event-ID последнего полученного события и продолжит с него.
+				sugar.Errorln("Could not replay events of user", user.ID, err.Error())
+			}
+			return
+		}
+	}
+	if !started {
+		start()
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if event.ID <= lastID {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			lastID = event.ID
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	pointsExpiryInterval = time.Hour
+	// expiringPointsLimit — сколько ближайших сроков сгорания показывать в балансе.
+	expiringPointsLimit = 3
+)
+
+type PointsExpiredEvent struct {
+	Sum       float64 `json:"sum"`
+	ExpiredAt string  `json:"expired_at"`
+}
+
+// pointsExpiresAt возвращает срок сгорания баллов, начисленных в accruedAt: полночь по UTC после того же числа
+// через PointsExpiryMonths месяцев. nil — баллы бессрочные.
+// Если в том месяце такого числа нет, берётся его последний день: иначе 31 января сгорало бы позже 1 февраля,
+// а партии тратятся в порядке начисления и должны в нём же сгорать.
+func (hv *HandlerVars) pointsExpiresAt(accruedAt time.Time) *time.Time {
+	if hv.PointsExpiryMonths <= 0 {
+		return nil
+	}
+	accruedAt = accruedAt.UTC()
+	month := accruedAt.Month() + time.Month(hv.PointsExpiryMonths)
+	day := accruedAt.Day()
+	// Нулевое число следующего месяца — последний день месяца month.
+	if lastDay := time.Date(accruedAt.Year(), month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > lastDay {
+		day = lastDay
+	}
+	expiresAt := time.Date(accruedAt.Year(), month, day+1, 0, 0, 0, 0, time.UTC)
+	return &expiresAt
+}
+
+// runPointsExpiryWorker раз в pointsExpiryInterval сжигает баллы с истёкшим сроком.
+func runPointsExpiryWorker(ctx context.Context, handlerVars *HandlerVars) {
+	ticker := time.NewTicker(pointsExpiryInterval)
+	defer ticker.Stop()
+	for {
+		expirePoints(handlerVars, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expirePoints сжигает истёкшие партии каждого пользователя в отдельной транзакции,
+// чтобы ошибка у одного пользователя не останавливала остальных.
+func expirePoints(handlerVars *HandlerVars, now time.Time) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetUsersWithExpiredPoints(now))
+	if err != nil {
+		sugar.Errorln("Could not find expired points. " + err.Error())
+		return
+	}
+	for _, loginID := range obj.([]int) {
+		obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.ExpirePoints(loginID, now))
+		if err != nil {
+			sugar.Errorln("Could not expire points of user", loginID, err.Error())
+			continue
+		}
+		expiry := obj.(*PointsExpiry)
+		if expiry.Expired == 0 {
+			continue
+		}
+		sugar.Infoln("expired", expiry.Expired, "points of user", loginID)
+		publishEvent(handlerVars, loginID, EventPointsExpired,
+			&PointsExpiredEvent{Sum: roundPoints(expiry.Expired), ExpiredAt: now.Format(time.RFC3339)})
+		for _, hold := range expiry.Released {
+			sugar.Infoln("released hold", hold.ID, "of user", loginID, "after points expired")
+			publishEvent(handlerVars, loginID, EventHoldReleased,
+				&HoldEvent{ID: hold.ID, Order: hold.Order, Sum: hold.Sum, Status: hold.Status})
+		}
+	}
+}
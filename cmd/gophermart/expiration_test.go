@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPointsExpiresAt(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	tests := []struct {
+		name      string
+		months    int
+		accruedAt time.Time
+		want      *time.Time
+	}{
+		{name: "disabled", months: 0, accruedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)},
+		{name: "negative disables", months: -1, accruedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)},
+		{name: "midnight after same day", months: 6, accruedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 9, 16, 0, 0, 0, 0, time.UTC))},
+		{name: "accrued at midnight", months: 1, accruedAt: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 4, 16, 0, 0, 0, 0, time.UTC))},
+		{name: "year rollover", months: 3, accruedAt: time.Date(2024, 11, 20, 23, 59, 0, 0, time.UTC),
+			want: timePtr(time.Date(2025, 2, 21, 0, 0, 0, 0, time.UTC))},
+		{name: "day counted in utc", months: 12, accruedAt: time.Date(2024, 3, 16, 1, 0, 0, 0, moscow),
+			want: timePtr(time.Date(2025, 3, 16, 0, 0, 0, 0, time.UTC))},
+		{name: "short month clamps to last day", months: 1, accruedAt: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))},
+		{name: "non-leap february", months: 1, accruedAt: time.Date(2023, 1, 29, 12, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC))},
+		{name: "day after clamped day", months: 1, accruedAt: time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))},
+		{name: "thirty day month", months: 6, accruedAt: time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC))},
+		{name: "clamp across year", months: 2, accruedAt: time.Date(2023, 12, 31, 12, 0, 0, 0, time.UTC),
+			want: timePtr(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hv := &HandlerVars{PointsExpiryMonths: tt.months}
+			got := hv.pointsExpiresAt(tt.accruedAt)
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("pointsExpiresAt() = %v, want nil", *got)
+				}
+				return
+			}
+			if got == nil || !got.Equal(*tt.want) || got.Location() != time.UTC {
+				t.Errorf("pointsExpiresAt() = %v, want %v", got, *tt.want)
+			}
+		})
+	}
+}
+
+// Сроки сгорания идут в порядке начисления: партии тратятся FIFO и не должны сгорать в обратном порядке.
+func TestPointsExpiresAtMonotonic(t *testing.T) {
+	for _, months := range []int{1, 2, 6, 12} {
+		hv := &HandlerVars{PointsExpiryMonths: months}
+		prev := hv.pointsExpiresAt(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+		for day := 1; day < 2*366; day++ {
+			accruedAt := time.Date(2023, 1, 1+day, 12, 0, 0, 0, time.UTC)
+			got := hv.pointsExpiresAt(accruedAt)
+			if got.Before(*prev) {
+				t.Fatalf("months %d: %v expires at %v, before the previous day's %v", months, accruedAt, *got, *prev)
+			}
+			prev = got
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
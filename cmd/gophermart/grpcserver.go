@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/kishenkoilya/ya-go-final.git/api/gophermartpb"
+)
+
+// grpcServer реализует gophermartpb.GophermartServer поверх тех же функций, что и HTTP-обработчики.
+type grpcServer struct {
+	gophermartpb.UnimplementedGophermartServer
+	// ctx живёт до остановки сервера: с ним закрываются потоки событий.
+	ctx         context.Context
+	handlerVars *HandlerVars
+}
+
+// grpcPublicMethods вызываются без токена авторизации.
+var grpcPublicMethods = map[string]bool{
+	gophermartpb.Gophermart_Register_FullMethodName:          true,
+	gophermartpb.Gophermart_Login_FullMethodName:             true,
+	gophermartpb.Gophermart_LoginSecondFactor_FullMethodName: true,
+}
+
+func runGRPCServer(ctx context.Context, address string, handlerVars *HandlerVars) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryInterceptor(handlerVars)),
+		grpc.StreamInterceptor(grpcStreamInterceptor(handlerVars)),
+	)
+	gophermartpb.RegisterGophermartServer(server, &grpcServer{ctx: ctx, handlerVars: handlerVars})
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			sugar.Fatalw(err.Error(), "event", "start grpc server")
+		}
+	}()
+	return server, nil
+}
+
+// grpcAuthenticate — аналог AuthMiddleware: токен берётся из метаданных authorization.
+func grpcAuthenticate(ctx context.Context, method string, handlerVars *HandlerVars) (context.Context, error) {
+	if grpcPublicMethods[method] {
+		return ctx, nil
+	}
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			auth = values[0]
+		}
+	}
+	user, err := authorization(auth, handlerVars.db)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return context.WithValue(ctx, User{}, user), nil
+}
+
+func grpcUnaryInterceptor(handlerVars *HandlerVars) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		var resp interface{}
+		ctx, err := grpcAuthenticate(ctx, info.FullMethod, handlerVars)
+		if err == nil {
+			resp, err = handler(ctx, req)
+		}
+		sugar.Infoln(
+			"grpc method", info.FullMethod,
+			"code", status.Code(err),
+			"duration", time.Since(start),
+		)
+		return resp, err
+	}
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamInterceptor(handlerVars *HandlerVars) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx, err := grpcAuthenticate(stream.Context(), info.FullMethod, handlerVars)
+		if err == nil {
+			err = handler(srv, &authServerStream{ServerStream: stream, ctx: ctx})
+		}
+		sugar.Infoln(
+			"grpc method", info.FullMethod,
+			"code", status.Code(err),
+			"duration", time.Since(start),
+		)
+		return err
+	}
+}
+
+// grpcError переводит ошибку общих с HTTP-обработчиками функций в статус gRPC.
+// Как и в HTTP API, клиент видит только *APIError, остальное пишется в лог.
+func grpcError(err error) error {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		sugar.Errorln(err.Error())
+		apiErr = errInternal
+	}
+	var c codes.Code
+	switch apiErr.Status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		c = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		c = codes.Unauthenticated
+	case http.StatusPaymentRequired:
+		c = codes.FailedPrecondition
+	case http.StatusForbidden:
+		c = codes.PermissionDenied
+	case http.StatusNotFound:
+		c = codes.NotFound
+	case http.StatusConflict:
+		c = codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		c = codes.ResourceExhausted
+	case http.StatusBadGateway:
+		c = codes.Unavailable
+	default:
+		c = codes.Internal
+	}
+	return status.Error(c, apiErr.Message)
+}
+
+func grpcUser(ctx context.Context) (*User, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return nil, grpcError(errInternal)
+	}
+	return user, nil
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *gophermartpb.Credentials) (*gophermartpb.AuthToken, error) {
+	if req.Login == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "login and password are required")
+	}
+	token, err := registerUser(&RegistrationInfo{LoginInfo: LoginInfo{Login: req.Login, Password: req.Password}}, s.handlerVars.db)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gophermartpb.AuthToken{Token: token}, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *gophermartpb.Credentials) (*gophermartpb.LoginResponse, error) {
+	loginInfo := LoginInfo{Login: req.Login, Password: req.Password}
+	userInfo, err := checkCredentials(&loginInfo, s.handlerVars.db)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	required, err := secondFactorRequired(userInfo.ID, s.handlerVars.db)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if required {
+		challenge, err := createLoginChallenge(userInfo.ID, s.handlerVars.db)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return &gophermartpb.LoginResponse{Result: &gophermartpb.LoginResponse_Challenge{Challenge: challenge}}, nil
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, s.handlerVars.db.CreateAuthToken(loginInfo.Login, userInfo.Hash))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gophermartpb.LoginResponse{Result: &gophermartpb.LoginResponse_Token{Token: obj.(string)}}, nil
+}
+
+func (s *grpcServer) LoginSecondFactor(ctx context.Context, req *gophermartpb.SecondFactorRequest) (*gophermartpb.AuthToken, error) {
+	if req.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "Code is required.")
+	}
+	token, err := passLoginChallenge(req.Challenge, req.Code, s.handlerVars.db)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gophermartpb.AuthToken{Token: token}, nil
+}
+
+func (s *grpcServer) UploadOrder(ctx context.Context, req *gophermartpb.UploadOrderRequest) (*gophermartpb.UploadOrderResponse, error) {
+	user, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	code, err := submitOrder(user.ID, req.Number, nil, s.handlerVars)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gophermartpb.UploadOrderResponse{Accepted: code == http.StatusAccepted}, nil
+}
+
+// pageQuery переводит параметры страницы в параметры запроса, чтобы разбирать их так же, как в HTTP API.
+func pageQuery(page *gophermartpb.PageRequest) url.Values {
+	query := url.Values{}
+	if page == nil {
+		return query
+	}
+	if page.Limit != 0 {
+		query.Set("limit", strconv.Itoa(int(page.Limit)))
+	}
+	if page.Cursor != "" {
+		query.Set("cursor", page.Cursor)
+	}
+	if page.From != "" {
+		query.Set("from", page.From)
+	}
+	if page.To != "" {
+		query.Set("to", page.To)
+	}
+	if page.Sort != "" {
+		query.Set("sort", page.Sort)
+	}
+	return query
+}
+
+func (s *grpcServer) ListOrders(ctx context.Context, req *gophermartpb.ListOrdersRequest) (*gophermartpb.ListOrdersResponse, error) {
+	user, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := pageQuery(req.Page)
+	query["status"] = req.Statuses
+	filter, err := parseOrdersFilter(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, s.handlerVars.db.GetOrdersInfo(user.ID, filter))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ordersPage := obj.(*OrdersPage)
+
+	resp := gophermartpb.ListOrdersResponse{Orders: make([]*gophermartpb.Order, 0, len(ordersPage.Orders))}
+	for _, order := range ordersPage.Orders {
+		resp.Orders = append(resp.Orders, &gophermartpb.Order{
+			Number:     order.Number,
+			Status:     order.Status,
+			Accrual:    order.Accrual,
+			UploadedAt: order.UploadedAt,
+		})
+	}
+	if ordersPage.Next != nil {
+		resp.NextCursor = ordersPage.Next.Encode()
+	}
+	return &resp, nil
+}
+
+// WatchOrders отдаёт изменения статусов заказов из того же EventBroker, что и SSE-поток /api/user/events.
+func (s *grpcServer) WatchOrders(req *gophermartpb.WatchOrdersRequest, stream gophermartpb.Gophermart_WatchOrdersServer) error {
+	user, err := grpcUser(stream.Context())
+	if err != nil {
+		return err
+	}
+	if req.LastEventId < 0 {
+		return status.Error(codes.InvalidArgument, "Incorrect last_event_id.")
+	}
+	lastID := int(req.LastEventId)
+
+	// Подписываемся до чтения истории, чтобы не потерять события между запросом и подпиской.
+	ch := s.handlerVars.events.Subscribe(user.ID)
+	defer s.handlerVars.events.Unsubscribe(user.ID, ch)
+
+	if lastID > 0 {
+		var sendErr error
+		lastID, err = replayEvents(s.handlerVars.db, user.ID, lastID, func(event *Event) error {
+			sendErr = sendOrderStatusUpdate(stream, event)
+			return sendErr
+		})
+		if err != nil {
+			if err == sendErr {
+				return err
+			}
+			return grpcError(err)
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.ctx.Done():
+			return status.Error(codes.Unavailable, "Server is shutting down.")
+		case event, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "Stream is too slow, resume with last_event_id.")
+			}
+			if event.ID <= lastID {
+				continue
+			}
+			if err := sendOrderStatusUpdate(stream, event); err != nil {
+				return err
+			}
+			lastID = event.ID
+		}
+	}
+}
+
+func sendOrderStatusUpdate(stream gophermartpb.Gophermart_WatchOrdersServer, event *Event) error {
+	if event.Type != EventOrderStatusChanged {
+		return nil
+	}
+	var payload OrderStatusEvent
+	err := json.Unmarshal([]byte(event.Data), &payload)
+	if err != nil {
+		sugar.Errorln(err.Error())
+		return nil
+	}
+	return stream.Send(&gophermartpb.OrderStatusUpdate{
+		EventId: int64(event.ID),
+		Number:  payload.Order,
+		Status:  payload.Status,
+		Accrual: payload.Accrual,
+	})
+}
+
+func (s *grpcServer) GetBalance(ctx context.Context, req *gophermartpb.GetBalanceRequest) (*gophermartpb.Balance, error) {
+	user, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, s.handlerVars.db.GetBalanceInfo(user.ID))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	balanceInfo := obj.(*BalanceInfo)
+	return &gophermartpb.Balance{Current: balanceInfo.Current, Withdrawn: balanceInfo.Withdrawn,
+		Held: balanceInfo.Held, Available: balanceInfo.Available}, nil
+}
+
+func (s *grpcServer) Withdraw(ctx context.Context, req *gophermartpb.WithdrawRequest) (*gophermartpb.WithdrawResponse, error) {
+	user, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Sum <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "sum must be greater than 0")
+	}
+	c, err := CheckLuhn(req.Order)
+	if err != nil || !c {
+		return nil, status.Error(codes.InvalidArgument, "Incorrect order number format.")
+	}
+
+	err = withdrawBalance(user.ID, req.Order, req.Sum, s.handlerVars)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gophermartpb.WithdrawResponse{}, nil
+}
+
+func (s *grpcServer) ListWithdrawals(ctx context.Context, req *gophermartpb.ListWithdrawalsRequest) (*gophermartpb.ListWithdrawalsResponse, error) {
+	user, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := pageQuery(req.Page)
+	if req.MinSum != nil {
+		query.Set("min_sum", strconv.FormatFloat(float64(*req.MinSum), 'f', -1, 32))
+	}
+	if req.MaxSum != nil {
+		query.Set("max_sum", strconv.FormatFloat(float64(*req.MaxSum), 'f', -1, 32))
+	}
+	filter, err := parseWithdrawalsFilter(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, s.handlerVars.db.GetWithdrawalsInfo(user.ID, filter))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	page := obj.(*WithdrawalsPage)
+
+	resp := gophermartpb.ListWithdrawalsResponse{
+		Withdrawals: make([]*gophermartpb.Withdrawal, 0, len(page.Withdrawals)),
+		TotalCount:  int32(page.TotalCount),
+		TotalSum:    page.TotalSum,
+	}
+	for _, withdrawal := range page.Withdrawals {
+		resp.Withdrawals = append(resp.Withdrawals, &gophermartpb.Withdrawal{
+			Order:       withdrawal.Order,
+			Sum:         withdrawal.Sum,
+			ProcessedAt: withdrawal.ProcessedAt,
+		})
+	}
+	if page.Next != nil {
+		resp.NextCursor = page.Next.Encode()
+	}
+	return &resp, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultHoldTTL = 15 * time.Minute
+	maxHoldTTL     = 24 * time.Hour
+	// holdReleaseInterval — как часто снимаются холды с истёкшим сроком.
+	holdReleaseInterval = time.Minute
+)
+
+// HoldRequest — удержание баллов под заказ. ExpiresIn задаётся в секундах, без него холд живёт defaultHoldTTL.
+type HoldRequest struct {
+	Order     string  `json:"order"`
+	Sum       float32 `json:"sum"`
+	ExpiresIn *int    `json:"expires_in"`
+}
+
+type HoldEvent struct {
+	ID     int     `json:"id"`
+	Order  string  `json:"order"`
+	Sum    float64 `json:"sum"`
+	Status string  `json:"status"`
+}
+
+// holdError переводит результат операции с холдом в ответ клиенту.
+func holdError(outcome string) *APIError {
+	switch outcome {
+	case HoldNotFound:
+		return NewAPIError(http.StatusNotFound, CodeNotFound, "Hold not found.")
+	case HoldNotActive:
+		return NewAPIError(http.StatusConflict, CodeHoldNotActive, "Hold is already captured, released or expired.")
+	case HoldOrderUsed:
+		return NewAPIError(http.StatusConflict, CodeOrderAlreadyUsed, "Order number is already used.")
+	case HoldInsufficientFunds:
+		return errInsufficientFunds
+	default:
+		return errInternal
+	}
+}
+
+func createHoldPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	var req HoldRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	c, err := CheckLuhn(req.Order)
+	if err != nil || !c {
+		writeError(w, errInvalidOrderNumber)
+		return
+	}
+	if req.Sum <= 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "sum must be positive."))
+		return
+	}
+	ttl := defaultHoldTTL
+	if req.ExpiresIn != nil {
+		ttl = time.Duration(*req.ExpiresIn) * time.Second
+		if ttl <= 0 || ttl > maxHoldTTL {
+			writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "expires_in must be between 1 and 86400 seconds."))
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.CreateHold(user.ID, req.Order, req.Sum, now, now.Add(ttl)))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	result := obj.(*HoldResult)
+	if result.Outcome != HoldOK {
+		writeError(w, holdError(result.Outcome))
+		return
+	}
+	hold := result.Hold
+	sugar.Infoln("user", user.ID, "held", hold.Sum, "for order", hold.Order)
+	publishEvent(handlerVars, user.ID, EventPointsHeld,
+		&HoldEvent{ID: hold.ID, Order: hold.Order, Sum: hold.Sum, Status: hold.Status})
+
+	respJSON, err := json.Marshal(hold)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respJSON)
+}
+
+// holdAction разбирает id холда и применяет к нему операцию action.
+func holdAction(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
+	action func(db *DBConnection, loginID, holdID int, now time.Time) RetryFunc) (*HandlerVars, *User, *Hold, bool) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return nil, nil, nil, false
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return nil, nil, nil, false
+	}
+
+	holdID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect hold id."))
+		return nil, nil, nil, false
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, action(handlerVars.db, user.ID, holdID, time.Now().UTC()))
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, nil, nil, false
+	}
+	result := obj.(*HoldResult)
+	if result.Outcome != HoldOK {
+		// Холд, снятый из-за нехватки баллов, всё равно освобождён: сообщаем об этом подписчикам.
+		if result.Hold != nil {
+			publishEvent(handlerVars, user.ID, EventHoldReleased, &HoldEvent{ID: result.Hold.ID,
+				Order: result.Hold.Order, Sum: result.Hold.Sum, Status: result.Hold.Status})
+		}
+		writeError(w, holdError(result.Outcome))
+		return nil, nil, nil, false
+	}
+	return handlerVars, user, result.Hold, true
+}
+
+func captureHoldPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, user, hold, ok := holdAction(w, r, ps, (*DBConnection).CaptureHold)
+	if !ok {
+		return
+	}
+	sugar.Infoln("user", user.ID, "captured hold", hold.ID, "for order", hold.Order)
+	publishEvent(handlerVars, user.ID, EventWithdrawalCompleted, &PointsEvent{Order: hold.Order, Sum: float32(hold.Sum)})
+	writeJSON(w, hold)
+}
+
+func releaseHoldPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, user, hold, ok := holdAction(w, r, ps, (*DBConnection).ReleaseHold)
+	if !ok {
+		return
+	}
+	sugar.Infoln("user", user.ID, "released hold", hold.ID, "for order", hold.Order)
+	publishEvent(handlerVars, user.ID, EventHoldReleased,
+		&HoldEvent{ID: hold.ID, Order: hold.Order, Sum: hold.Sum, Status: hold.Status})
+	writeJSON(w, hold)
+}
+
+func holdsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetHolds(user.ID, time.Now().UTC()))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	holds := obj.([]Hold)
+	if len(holds) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, holds)
+}
+
+// runHoldReleaseWorker раз в holdReleaseInterval снимает холды, которые не были списаны или сняты до своего срока.
+func runHoldReleaseWorker(ctx context.Context, handlerVars *HandlerVars) {
+	ticker := time.NewTicker(holdReleaseInterval)
+	defer ticker.Stop()
+	for {
+		releaseExpiredHolds(handlerVars, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseExpiredHolds снимает истёкшие холды каждого пользователя в отдельной транзакции.
+func releaseExpiredHolds(handlerVars *HandlerVars, now time.Time) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetUsersWithExpiredHolds(now))
+	if err != nil {
+		sugar.Errorln("Could not find expired holds. " + err.Error())
+		return
+	}
+	for _, loginID := range obj.([]int) {
+		obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.ReleaseExpiredHolds(loginID, now))
+		if err != nil {
+			sugar.Errorln("Could not release expired holds of user", loginID, err.Error())
+			continue
+		}
+		for _, hold := range obj.([]Hold) {
+			sugar.Infoln("released expired hold", hold.ID, "of user", loginID)
+			publishEvent(handlerVars, loginID, EventHoldReleased,
+				&HoldEvent{ID: hold.ID, Order: hold.Order, Sum: hold.Sum, Status: hold.Status})
+		}
+	}
+}
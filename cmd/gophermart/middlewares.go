@@ -1,19 +1,29 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
-	"io"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/jackc/pgerrcode"
 	"github.com/julienschmidt/httprouter"
 )
 
 type HandlerVars struct {
 	db                   *DBConnection
+	events               *EventBroker
 	AccrualSystemAddress *string
+	// PointsExpiryMonths — через сколько месяцев сгорают начисленные баллы; 0 — бессрочно.
+	PointsExpiryMonths int
+	Tiers              *TierPolicy
+	// ReferralBonus — сколько баллов получают пригласивший и приглашённый; 0 — бонус не начисляется.
+	ReferralBonus float64
+	ReferralLimit int
+	// TransferConfirmOver — переводы больше этой суммы ждут подтверждения отправителем; 0 — подтверждение не нужно.
+	TransferConfirmOver float64
+	TransferLimits      TransferLimits
+	// ctx живёт до остановки сервера: фоновые задачи, запущенные из обработчиков, не должны прерываться вместе с запросом.
+	ctx context.Context
 }
 
 func ParamsMiddleware(next httprouter.Handle, handlerVars *HandlerVars) httprouter.Handle {
@@ -23,6 +33,128 @@ func ParamsMiddleware(next httprouter.Handle, handlerVars *HandlerVars) httprout
 	})
 }
 
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+)
+
+type User struct {
+	ID    int
+	Login string
+	Role  string
+}
+
+// AuthMiddleware проверяет токен из заголовка Authorization и кладёт пользователя в контекст запроса.
+// Должен вызываться внутри ParamsMiddleware.
+func AuthMiddleware(next httprouter.Handle) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+		if !ok {
+			writeError(w, errInternal)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		user, err := authorization(auth, handlerVars.db)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), User{}, user)
+		next(w, r.WithContext(ctx), ps)
+	})
+}
+
+// RoleMiddleware пропускает запрос только если роль пользователя входит в roles.
+// Должен вызываться внутри AuthMiddleware.
+func RoleMiddleware(next httprouter.Handle, roles ...string) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			writeError(w, errInternal)
+			return
+		}
+		for _, role := range roles {
+			if user.Role == role {
+				next(w, r, ps)
+				return
+			}
+		}
+		writeError(w, errForbidden)
+	})
+}
+
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(User{}).(*User)
+	return user, ok
+}
+
+const (
+	ScopeOrdersWrite        = "orders:write"
+	ScopeWithdrawalsReverse = "withdrawals:reverse"
+)
+
+// ServiceKey содержит срез и не может сам служить ключом контекста.
+type serviceKeyContextKey struct{}
+
+// ServiceKey — принципал сервисного вызова по API-ключу.
+type ServiceKey struct {
+	ID     int
+	Name   string
+	Scopes []string
+}
+
+func (key *ServiceKey) HasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyMiddleware проверяет ключ из заголовка X-API-Key и его право на scope.
+// Должен вызываться внутри ParamsMiddleware.
+func APIKeyMiddleware(next httprouter.Handle, scope string) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+		if !ok {
+			writeError(w, errInternal)
+			return
+		}
+
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			writeError(w, errUnauthorized)
+			return
+		}
+		obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.CheckAPIKey(HashToken(apiKey)))
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		key := obj.(*ServiceKey)
+		if key == nil {
+			writeError(w, errUnauthorized)
+			return
+		}
+		if !key.HasScope(scope) {
+			writeError(w, errForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), serviceKeyContextKey{}, key)
+		next(w, r.WithContext(ctx), ps)
+	})
+}
+
+func ServiceKeyFromContext(ctx context.Context) (*ServiceKey, bool) {
+	key, ok := ctx.Value(serviceKeyContextKey{}).(*ServiceKey)
+	return key, ok
+}
+
 func LoggingMiddleware(next httprouter.Handle) httprouter.Handle {
 	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		start := time.Now()
@@ -41,6 +173,7 @@ func LoggingMiddleware(next httprouter.Handle) httprouter.Handle {
 			"duration", duration,
 			"size", rw.Size,
 			"Accept-Encoding", r.Header.Get("Accept-Encoding"),
+			"request_id", rw.Header().Get(requestIDHeader),
 		)
 	})
 }
@@ -71,30 +204,8 @@ func (lrw *LogResponseWriter) WriteHeader(statusCode int) {
 	}
 }
 
-func GzipMiddleware(next httprouter.Handle) httprouter.Handle {
-	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next(w, r, ps)
-			return
-		}
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			io.WriteString(w, err.Error())
-			return
-		}
-		defer gz.Close()
-
-		w.Header().Set("Content-Encoding", "gzip")
-
-		next(gzipWriter{ResponseWriter: w, Writer: gz}, r, ps)
-	})
-}
-
-type gzipWriter struct {
-	http.ResponseWriter
-	Writer io.Writer
-}
-
-func (w gzipWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+func (lrw *LogResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
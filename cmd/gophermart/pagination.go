@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// PageCursor указывает на последнюю запись выданной страницы. Клиенту он передаётся непрозрачной строкой.
+type PageCursor struct {
+	At time.Time
+	ID int
+}
+
+func (c *PageCursor) Encode() string {
+	raw := fmt.Sprintf("%d:%d", c.At.UnixNano(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodePageCursor(s string) (*PageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &PageCursor{At: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// PageParams — общие параметры постраничной выдачи. Нулевое значение означает «всё одним списком».
+type PageParams struct {
+	From   time.Time
+	To     time.Time
+	Desc   bool
+	Limit  int
+	Cursor *PageCursor
+}
+
+// parsePageParams читает limit, cursor, from, to и sort. defaultDesc задаёт порядок при отсутствии sort.
+func parsePageParams(query url.Values, defaultDesc bool) (*PageParams, error) {
+	params := PageParams{Desc: defaultDesc}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		params.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("from must be an RFC3339 timestamp")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		params.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("to must be an RFC3339 timestamp")
+		}
+	}
+
+	switch query.Get("sort") {
+	case "":
+	case "asc":
+		params.Desc = false
+	case "desc":
+		params.Desc = true
+	default:
+		return nil, errors.New("sort must be asc or desc")
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		params.Cursor, err = DecodePageCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		params.Limit = defaultPageLimit
+	}
+	if v := query.Get("limit"); v != "" {
+		params.Limit, err = strconv.Atoi(v)
+		if err != nil || params.Limit <= 0 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+		if params.Limit > maxPageLimit {
+			params.Limit = maxPageLimit
+		}
+	}
+	return &params, nil
+}
+
+// pageConditions дописывает к запросу условия диапазона дат и курсора по колонке времени column.
+func pageConditions(params *PageParams, column string, args []interface{}) (string, []interface{}) {
+	var conditions string
+	if !params.From.IsZero() {
+		args = append(args, params.From)
+		conditions += fmt.Sprintf(" AND %s>=$%d", column, len(args))
+	}
+	if !params.To.IsZero() {
+		args = append(args, params.To)
+		conditions += fmt.Sprintf(" AND %s<$%d", column, len(args))
+	}
+	if params.Cursor != nil {
+		args = append(args, params.Cursor.At, params.Cursor.ID)
+		op := ">"
+		if params.Desc {
+			op = "<"
+		}
+		conditions += fmt.Sprintf(" AND (%s, id)%s($%d, $%d)", column, op, len(args)-1, len(args))
+	}
+	return conditions, args
+}
+
+// pageOrder возвращает ORDER BY и LIMIT; лимит запрашивается на одну запись больше, чтобы узнать о следующей странице.
+func pageOrder(params *PageParams, column string, args []interface{}) (string, []interface{}) {
+	direction := "ASC"
+	if params.Desc {
+		direction = "DESC"
+	}
+	clause := fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	if params.Limit > 0 {
+		args = append(args, params.Limit+1)
+		clause += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	return clause, args
+}
+
+// setNextPageLink выставляет заголовок Link на следующую страницу с тем же набором фильтров.
+func setNextPageLink(w http.ResponseWriter, r *http.Request, next *PageCursor) {
+	if next == nil {
+		return
+	}
+	query := r.URL.Query()
+	query.Set("cursor", next.Encode())
+	nextURL := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", "<"+nextURL.String()+">; rel=\"next\"")
+}
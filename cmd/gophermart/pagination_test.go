@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor PageCursor
+	}{
+		{name: "regular", cursor: PageCursor{At: time.Date(2024, 3, 1, 10, 20, 30, 123456789, time.UTC), ID: 42}},
+		{name: "zero id", cursor: PageCursor{At: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), ID: 0}},
+		{name: "before epoch", cursor: PageCursor{At: time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), ID: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePageCursor(tt.cursor.Encode())
+			if err != nil {
+				t.Fatalf("DecodePageCursor() error = %v", err)
+			}
+			if !got.At.Equal(tt.cursor.At) || got.ID != tt.cursor.ID {
+				t.Errorf("DecodePageCursor() = %v/%d, want %v/%d", got.At, got.ID, tt.cursor.At, tt.cursor.ID)
+			}
+		})
+	}
+}
+
+func TestPageCursorEncodeNormalizesZone(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	at := time.Date(2024, 3, 1, 13, 0, 0, 0, loc)
+	got, err := DecodePageCursor((&PageCursor{At: at, ID: 1}).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.At.Location() != time.UTC || !got.At.Equal(at) {
+		t.Errorf("DecodePageCursor() At = %v, want %v in UTC", got.At, at.UTC())
+	}
+}
+
+func TestDecodePageCursorInvalid(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "empty", input: ""},
+		{name: "not base64", input: "!!!"},
+		{name: "padded base64", input: base64.URLEncoding.EncodeToString([]byte("1:23"))},
+		{name: "no separator", input: encode("12345")},
+		{name: "extra part", input: encode("1:2:3")},
+		{name: "non-numeric time", input: encode("abc:1")},
+		{name: "non-numeric id", input: encode("1:abc")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodePageCursor(tt.input); err == nil {
+				t.Errorf("DecodePageCursor(%q) error = nil, want error", tt.input)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgerrcode"
@@ -51,8 +54,9 @@ func errCodeCompare(errClass, errCode string) bool {
 	}
 }
 
+// DBConnection использует пул: к базе одновременно обращаются обработчики запросов и фоновые задачи.
 type DBConnection struct {
-	conn *pgx.Conn
+	conn *pgx.ConnPool
 }
 
 func NewDBConnection(DatabaseURI string) RetryFunc {
@@ -61,7 +65,7 @@ func NewDBConnection(DatabaseURI string) RetryFunc {
 		if err != nil {
 			return nil, err
 		}
-		db, err := pgx.Connect(connConfig)
+		db, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: connConfig, MaxConnections: 10})
 		if err != nil {
 			return nil, err
 		}
@@ -69,8 +73,8 @@ func NewDBConnection(DatabaseURI string) RetryFunc {
 	}
 }
 
-func (db *DBConnection) Close() error {
-	return db.conn.Close()
+func (db *DBConnection) Close() {
+	db.conn.Close()
 }
 
 func (db *DBConnection) InitTables() RetryFunc {
@@ -87,6 +91,22 @@ func (db *DBConnection) InitTables() RetryFunc {
 		}
 		sugar.Infoln(res)
 
+		query = `ALTER TABLE GophermartUsers 
+			ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'customer', 
+			ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false, 
+			ADD COLUMN IF NOT EXISTS data_version BIGINT NOT NULL DEFAULT 0, 
+			ADD COLUMN IF NOT EXISTS data_changed_at TIMESTAMPTZ NOT NULL DEFAULT now(), 
+			ADD COLUMN IF NOT EXISTS tier VARCHAR(50), 
+			ADD COLUMN IF NOT EXISTS referral_code VARCHAR(20) UNIQUE, 
+			ADD COLUMN IF NOT EXISTS referred_by INTEGER REFERENCES GophermartUsers(id) CHECK (referred_by<>id), 
+			ADD COLUMN IF NOT EXISTS referred_at TIMESTAMPTZ, 
+			ADD COLUMN IF NOT EXISTS held DOUBLE PRECISION NOT NULL DEFAULT 0;`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
 		query = `CREATE TABLE IF NOT EXISTS GophermartAuthentications (
 			id SERIAL PRIMARY KEY, 
 			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL UNIQUE, 
@@ -111,17 +131,357 @@ func (db *DBConnection) InitTables() RetryFunc {
 		}
 		sugar.Infoln(res)
 
+		query = `ALTER TABLE GophermartOrders 
+			ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMPTZ;`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartAdjustments (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			admin_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			sum DOUBLE PRECISION NOT NULL, 
+			reason VARCHAR(50) NOT NULL, 
+			comment TEXT NOT NULL, 
+			processed_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartAPIKeys (
+			id SERIAL PRIMARY KEY, 
+			name VARCHAR(250) NOT NULL, 
+			key_hash TEXT NOT NULL UNIQUE, 
+			scopes TEXT NOT NULL, 
+			created_by INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL, 
+			revoked_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartTOTP (
+			login_id INTEGER REFERENCES GophermartUsers(id) PRIMARY KEY, 
+			secret TEXT NOT NULL, 
+			confirmed BOOLEAN NOT NULL DEFAULT false, 
+			last_step BIGINT NOT NULL DEFAULT 0);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `ALTER TABLE GophermartTOTP 
+			ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0, 
+			ADD COLUMN IF NOT EXISTS failures_since TIMESTAMPTZ;`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartRecoveryCodes (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			code_hash TEXT NOT NULL, 
+			used_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartLoginChallenges (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			token_hash TEXT NOT NULL UNIQUE, 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			expires_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartEvents (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			type VARCHAR(50) NOT NULL, 
+			data TEXT NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartWebhooks (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			url TEXT NOT NULL, 
+			secret TEXT NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartWebhookDeliveries (
+			id SERIAL PRIMARY KEY, 
+			webhook_id INTEGER REFERENCES GophermartWebhooks(id) ON DELETE CASCADE NOT NULL, 
+			event_type VARCHAR(50) NOT NULL, 
+			data TEXT NOT NULL, 
+			status VARCHAR(20) NOT NULL, 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			last_response_code INTEGER, 
+			next_attempt_at TIMESTAMPTZ NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartWebhookAttempts (
+			id SERIAL PRIMARY KEY, 
+			delivery_id INTEGER REFERENCES GophermartWebhookDeliveries(id) ON DELETE CASCADE NOT NULL, 
+			response_code INTEGER, 
+			error TEXT, 
+			attempted_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartPointLots (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			source VARCHAR(20) NOT NULL, 
+			number VARCHAR(50), 
+			amount DOUBLE PRECISION NOT NULL, 
+			remaining DOUBLE PRECISION NOT NULL, 
+			accrued_at TIMESTAMPTZ NOT NULL, 
+			expires_at TIMESTAMPTZ, 
+			expired_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartExpirations (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			lot_id INTEGER REFERENCES GophermartPointLots(id) NOT NULL, 
+			sum DOUBLE PRECISION NOT NULL, 
+			processed_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartTierChanges (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			from_tier VARCHAR(50) NOT NULL, 
+			to_tier VARCHAR(50) NOT NULL, 
+			accrued DOUBLE PRECISION NOT NULL, 
+			changed_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartCampaigns (
+			id SERIAL PRIMARY KEY, 
+			name VARCHAR(100) NOT NULL, 
+			starts_at TIMESTAMPTZ NOT NULL, 
+			ends_at TIMESTAMPTZ NOT NULL, 
+			multiplier DOUBLE PRECISION NOT NULL, 
+			bonus DOUBLE PRECISION NOT NULL, 
+			tiers TEXT NOT NULL, 
+			budget DOUBLE PRECISION, 
+			spent DOUBLE PRECISION NOT NULL DEFAULT 0, 
+			created_by INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL, 
+			disabled_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartCampaignUsers (
+			campaign_id INTEGER REFERENCES GophermartCampaigns(id) NOT NULL, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			PRIMARY KEY (campaign_id, login_id));`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartCampaignBonuses (
+			id SERIAL PRIMARY KEY, 
+			campaign_id INTEGER REFERENCES GophermartCampaigns(id) NOT NULL, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			number VARCHAR(50) NOT NULL, 
+			accrual DOUBLE PRECISION NOT NULL, 
+			amount DOUBLE PRECISION NOT NULL, 
+			credited_at TIMESTAMPTZ NOT NULL, 
+			UNIQUE (campaign_id, number));`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartReferralBonuses (
+			id SERIAL PRIMARY KEY, 
+			referrer_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			referred_id INTEGER REFERENCES GophermartUsers(id) UNIQUE NOT NULL, 
+			number VARCHAR(50) NOT NULL, 
+			referrer_bonus DOUBLE PRECISION NOT NULL, 
+			referred_bonus DOUBLE PRECISION NOT NULL, 
+			credited_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartTransfers (
+			id SERIAL PRIMARY KEY, 
+			from_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			to_id INTEGER REFERENCES GophermartUsers(id) NOT NULL CHECK (to_id<>from_id), 
+			sum DOUBLE PRECISION NOT NULL, 
+			comment TEXT NOT NULL, 
+			status VARCHAR(20) NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL, 
+			expires_at TIMESTAMPTZ, 
+			completed_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartReversals (
+			id SERIAL PRIMARY KEY, 
+			order_id INTEGER REFERENCES GophermartOrders(id) NOT NULL, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			sum DOUBLE PRECISION NOT NULL, 
+			reason TEXT NOT NULL, 
+			admin_id INTEGER REFERENCES GophermartUsers(id), 
+			api_key_id INTEGER REFERENCES GophermartAPIKeys(id), 
+			processed_at TIMESTAMPTZ NOT NULL);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		// Списание можно отменять частями, поэтому отмен по одному заказу может быть несколько.
+		query = `ALTER TABLE GophermartReversals 
+			DROP CONSTRAINT IF EXISTS gophermartreversals_order_id_key;`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE INDEX IF NOT EXISTS gophermart_reversals_order ON GophermartReversals (order_id);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		// api_key_id — ключ сервиса, зарегистрировавшего заказ; по нему сервису разрешены отмены списаний.
+		query = `ALTER TABLE GophermartOrders 
+			ADD COLUMN IF NOT EXISTS api_key_id INTEGER REFERENCES GophermartAPIKeys(id);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `CREATE TABLE IF NOT EXISTS GophermartHolds (
+			id SERIAL PRIMARY KEY, 
+			login_id INTEGER REFERENCES GophermartUsers(id) NOT NULL, 
+			number VARCHAR(50) NOT NULL, 
+			sum DOUBLE PRECISION NOT NULL, 
+			status VARCHAR(20) NOT NULL, 
+			created_at TIMESTAMPTZ NOT NULL, 
+			expires_at TIMESTAMPTZ NOT NULL, 
+			resolved_at TIMESTAMPTZ);`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		// Под один номер заказа может быть только один действующий холд.
+		query = `CREATE UNIQUE INDEX IF NOT EXISTS gophermart_holds_active_number 
+			ON GophermartHolds (number) WHERE status='held';`
+		res, err = db.conn.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
 		return nil, nil
 	}
 }
 
-func (db *DBConnection) WriteNewUserInfo(login, hash string) RetryFunc {
+var (
+	ErrLoginExists         = errors.New("Login exists")
+	ErrInvalidReferralCode = errors.New("Referral code does not exist")
+	ErrLoginNotExist       = errors.New("Login does not exist")
+	ErrAccountDisabled     = errors.New("Account disabled")
+)
+
+// WriteNewUserInfo создаёт пользователя. Непустой referralCode связывает его с пригласившим;
+// коды отключённых пользователей не принимаются.
+func (db *DBConnection) WriteNewUserInfo(login, hash, referralCode string) RetryFunc {
 	return func() (interface{}, error) {
+		var referrerID *int
+		var referredAt *time.Time
+		if referralCode != "" {
+			query := `SELECT id 
+			FROM GophermartUsers 
+			WHERE referral_code=$1 AND NOT disabled`
+			var id int
+			err := db.conn.QueryRow(query, referralCode).Scan(&id)
+			if err != nil {
+				if err == pgx.ErrNoRows {
+					return nil, ErrInvalidReferralCode
+				}
+				return nil, err
+			}
+			now := time.Now().UTC()
+			referrerID, referredAt = &id, &now
+		}
+
 		query := `INSERT INTO GophermartUsers 
-		(login, password_hash, current_balance, balance_withdrawn) 
-		VALUES($1, $2, 0, 0)`
-		res, err := db.conn.Exec(query, login, hash)
+		(login, password_hash, current_balance, balance_withdrawn, referred_by, referred_at) 
+		VALUES($1, $2, 0, 0, $3, $4)`
+		res, err := db.conn.Exec(query, login, hash, referrerID, referredAt)
 		if err != nil {
+			if pgerr, ok := err.(pgx.PgError); ok && pgerr.Code == pgerrcode.UniqueViolation {
+				return nil, ErrLoginExists
+			}
 			return nil, err
 		}
 		sugar.Infoln(res)
@@ -131,31 +491,62 @@ func (db *DBConnection) WriteNewUserInfo(login, hash string) RetryFunc {
 }
 
 type UserInfo struct {
-	Login string
-	Hash  string
+	ID       int
+	Login    string
+	Hash     string
+	Role     string
+	Disabled bool
 }
 
 func (db *DBConnection) GetUserInfo(login string) RetryFunc {
 	return func() (interface{}, error) {
-		query := `SELECT password_hash 
+		query := `SELECT id, password_hash, role, disabled 
 		FROM GophermartUsers 
 		WHERE login=$1`
 		sugar.Infoln(login)
-		res, err := db.conn.Query(query, login)
-		if err != nil {
-			return nil, err
-		}
 		uInfo := UserInfo{Login: login}
-		for res.Next() {
-			err := res.Scan(&uInfo.Hash)
-			if err != nil {
-				return nil, err
+		err := db.conn.QueryRow(query, login).Scan(&uInfo.ID, &uInfo.Hash, &uInfo.Role, &uInfo.Disabled)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return nil, ErrLoginNotExist
 			}
+			return nil, err
 		}
 		return &uInfo, nil
 	}
 }
 
+func (db *DBConnection) SetUserRole(login, role string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartUsers 
+		SET role=$1
+		WHERE login=$2`
+		res, err := db.conn.Exec(query, role, login)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		if res.RowsAffected() == 0 {
+			return nil, ErrLoginNotExist
+		}
+		return nil, nil
+	}
+}
+
+func (db *DBConnection) SetUserDisabled(loginID int, disabled bool) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartUsers 
+		SET disabled=$1
+		WHERE id=$2`
+		res, err := db.conn.Exec(query, disabled, loginID)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return nil, nil
+	}
+}
+
 func (db *DBConnection) CreateAuthToken(login, hash string) RetryFunc {
 	return func() (interface{}, error) {
 		query := `SELECT id FROM GophermartUsers WHERE login=$1`
@@ -186,26 +577,35 @@ func (db *DBConnection) CreateAuthToken(login, hash string) RetryFunc {
 
 func (db *DBConnection) CheckAuthToken(auth string) RetryFunc {
 	return func() (interface{}, error) {
-		query := `SELECT login_id 
-		FROM GophermartAuthentications 
-		WHERE token=$1`
+		query := `SELECT a.login_id, u.login, u.role, u.disabled 
+		FROM GophermartAuthentications a 
+		JOIN GophermartUsers u ON u.id=a.login_id 
+		WHERE a.token=$1`
 
-		var loginID int
+		var user User
+		var disabled bool
 		sugar.Infoln(auth)
-		err := db.conn.QueryRow(query, auth).Scan(&loginID)
+		err := db.conn.QueryRow(query, auth).Scan(&user.ID, &user.Login, &user.Role, &disabled)
 		if err != nil {
-			return -1, err
+			if err == pgx.ErrNoRows {
+				return (*User)(nil), nil
+			}
+			return nil, err
+		}
+		if disabled {
+			return nil, ErrAccountDisabled
 		}
-		return loginID, nil
+		return &user, nil
 	}
 }
 
-func (db *DBConnection) LoadOrderNumber(loginID int, orderNum string) RetryFunc {
+// LoadOrderNumber регистрирует заказ пользователя; apiKeyID — ключ сервиса, от имени которого он загружен (nil — сам пользователь).
+func (db *DBConnection) LoadOrderNumber(loginID int, orderNum string, apiKeyID *int) RetryFunc {
 	return func() (interface{}, error) {
 		query := `INSERT INTO GophermartOrders 
-		(login_id, number, status, accrual, withdrawn, uploaded_at) 
-		VALUES($1, $2, 'NEW', 0, 0, $3)`
-		res, err := db.conn.Exec(query, loginID, orderNum, time.Now().UTC())
+		(login_id, number, status, accrual, withdrawn, uploaded_at, status_changed_at, api_key_id) 
+		VALUES($1, $2, 'NEW', 0, 0, $3, $3, $4)`
+		res, err := db.conn.Exec(query, loginID, orderNum, time.Now().UTC(), apiKeyID)
 		if err != nil {
 			if err.(pgx.PgError).Code == "23505" {
 				query = `SELECT login_id 
@@ -221,6 +621,10 @@ func (db *DBConnection) LoadOrderNumber(loginID int, orderNum string) RetryFunc
 			return nil, err
 		}
 		sugar.Infoln(res)
+		err = bumpDataVersion(db.conn, loginID)
+		if err != nil {
+			return nil, err
+		}
 		var orderID int
 		query = `SELECT id FROM GophermartOrders WHERE number=$1`
 		err = db.conn.QueryRow(query, orderNum).Scan(&orderID)
@@ -231,128 +635,270 @@ func (db *DBConnection) LoadOrderNumber(loginID int, orderNum string) RetryFunc
 	}
 }
 
-func (db *DBConnection) UpdateOrder(accrual float32, orderNum, status string) RetryFunc {
+// UpdateOrder возвращает true, если статус или начисление заказа изменились.
+// Заказы в конечном статусе больше не меняются. Переход в PROCESSED в той же транзакции зачисляет баллы
+// и заводит на них партию, которая сгорит в expiresAt (nil — бессрочно): статус не может смениться без начисления.
+func (db *DBConnection) UpdateOrder(accrual float32, orderNum, status string, expiresAt *time.Time) RetryFunc {
 	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		now := time.Now().UTC()
 		query := `UPDATE GophermartOrders 
-		SET accrual=$1, status=$2
-		WHERE number=$3`
-		res, err := db.conn.Exec(query, accrual, status, orderNum)
+		SET accrual=$1, status=$2, status_changed_at=$4
+		WHERE number=$3 AND status NOT IN ('INVALID', 'PROCESSED') AND (status<>$2 OR accrual<>$1)
+		RETURNING login_id`
+		var loginID int
+		err = tx.QueryRow(query, accrual, status, orderNum, now).Scan(&loginID)
 		if err != nil {
+			if err == pgx.ErrNoRows {
+				return false, nil
+			}
 			return nil, err
 		}
-		sugar.Infoln(res)
-		return nil, nil
-	}
-}
 
-func (db *DBConnection) AddLoyaltyPoints(loginID int, accrual float32) RetryFunc {
-	return func() (interface{}, error) {
-		query := `UPDATE GophermartUsers 
-		SET current_balance=current_balance+$1
+		var credit float32
+		if status == "PROCESSED" && accrual > 0 {
+			credit = accrual
+		}
+		query = `UPDATE GophermartUsers 
+		SET current_balance=current_balance+$1, data_version=data_version+1, data_changed_at=$3
 		WHERE id=$2`
-		res, err := db.conn.Exec(query, accrual, loginID)
+		res, err := tx.Exec(query, credit, loginID, now)
 		if err != nil {
 			return nil, err
 		}
 		sugar.Infoln(res)
-		return nil, nil
-	}
-}
-
-type OrderInfo struct {
-	Number     string  `json:"number"`
-	Status     string  `json:"status"`
-	Accrual    float32 `json:"accrual"`
-	UploadedAt string  `json:"uploaded_at"`
-}
 
-func (db *DBConnection) GetOrdersInfo(loginID int) RetryFunc {
+		if credit > 0 {
+			err = insertPointLot(tx, loginID, PointLotAccrual, orderNum, float64(credit), now, expiresAt)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+}
+
+type OrderInfo struct {
+	Number     string  `json:"number"`
+	Status     string  `json:"status"`
+	Accrual    float32 `json:"accrual"`
+	UploadedAt string  `json:"uploaded_at"`
+}
+
+type OrderDetails struct {
+	LoginID         int     `json:"-"`
+	Number          string  `json:"number"`
+	Status          string  `json:"status"`
+	Accrual         float32 `json:"accrual"`
+	UploadedAt      string  `json:"uploaded_at"`
+	StatusChangedAt string  `json:"status_changed_at"`
+}
+
+// GetOrderDetails возвращает заказ по номеру или nil, если такого номера нет.
+func (db *DBConnection) GetOrderDetails(orderNum string) RetryFunc {
 	return func() (interface{}, error) {
-		var orders []OrderInfo
-		query := `SELECT number, status, accrual, uploaded_at 
+		query := `SELECT login_id, number, status, accrual, uploaded_at, COALESCE(status_changed_at, uploaded_at) 
 		FROM GophermartOrders 
-		WHERE login_id=$1 
-		ORDER BY uploaded_at ASC`
-		res, err := db.conn.Query(query, loginID)
+		WHERE number=$1`
+		var order OrderDetails
+		var uploadedAt, changedAt pgtype.Timestamptz
+		err := db.conn.QueryRow(query, orderNum).
+			Scan(&order.LoginID, &order.Number, &order.Status, &order.Accrual, &uploadedAt, &changedAt)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return (*OrderDetails)(nil), nil
+			}
+			return nil, err
+		}
+		order.UploadedAt = uploadedAt.Time.Format(time.RFC3339)
+		order.StatusChangedAt = changedAt.Time.Format(time.RFC3339)
+		return &order, nil
+	}
+}
+
+type OrdersFilter struct {
+	PageParams
+	Statuses []string
+}
+
+type OrdersPage struct {
+	Orders []OrderInfo
+	Next   *PageCursor
+}
+
+func (db *DBConnection) GetOrdersInfo(loginID int, filter *OrdersFilter) RetryFunc {
+	return func() (interface{}, error) {
+		var page OrdersPage
+		args := []interface{}{loginID}
+		query := `SELECT id, number, status, accrual, uploaded_at 
+		FROM GophermartOrders 
+		WHERE login_id=$1`
+		if len(filter.Statuses) > 0 {
+			args = append(args, filter.Statuses)
+			query += fmt.Sprintf(" AND status=ANY($%d)", len(args))
+		}
+		var conditions, order string
+		conditions, args = pageConditions(&filter.PageParams, "uploaded_at", args)
+		order, args = pageOrder(&filter.PageParams, "uploaded_at", args)
+		query += conditions + order
+
+		res, err := db.conn.Query(query, args...)
 		if err != nil {
 			return nil, err
 		}
+		defer res.Close()
+		var last PageCursor
 		for res.Next() {
+			if filter.Limit > 0 && len(page.Orders) == filter.Limit {
+				res.Close()
+				page.Next = &PageCursor{At: last.At, ID: last.ID}
+				break
+			}
 			var order OrderInfo
 			var myTime pgtype.Timestamptz
-			err := res.Scan(&order.Number, &order.Status, &order.Accrual, &myTime)
+			err := res.Scan(&last.ID, &order.Number, &order.Status, &order.Accrual, &myTime)
 			if err != nil {
 				return nil, err
 			}
+			last.At = myTime.Time
 			order.UploadedAt = myTime.Time.Format(time.RFC3339)
-			orders = append(orders, order)
+			page.Orders = append(page.Orders, order)
 		}
 
-		return &orders, nil
+		return &page, nil
+	}
+}
+
+// DataVersion растёт при каждом изменении заказов, начислений или списаний пользователя.
+type DataVersion struct {
+	Version   int64
+	ChangedAt time.Time
+}
+
+// bumpDataVersion отмечает изменение данных пользователя, которые отдаются с ETag.
+func bumpDataVersion(conn *pgx.ConnPool, loginID int) error {
+	query := `UPDATE GophermartUsers 
+	SET data_version=data_version+1, data_changed_at=$2
+	WHERE id=$1`
+	_, err := conn.Exec(query, loginID, time.Now().UTC())
+	return err
+}
+
+func (db *DBConnection) GetDataVersion(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `SELECT data_version, data_changed_at 
+		FROM GophermartUsers 
+		WHERE id=$1`
+		var version DataVersion
+		err := db.conn.QueryRow(query, loginID).Scan(&version.Version, &version.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		return &version, nil
 	}
 }
 
+// BalanceInfo — баланс пользователя. Current включает баллы, удержанные под холды (Held);
+// списать можно только Available.
 type BalanceInfo struct {
-	Current   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Current      float32          `json:"current"`
+	Held         float32          `json:"held"`
+	Available    float32          `json:"available"`
+	Withdrawn    float32          `json:"withdrawn"`
+	ExpiringSoon []ExpiringPoints `json:"expiring_soon,omitempty"`
 }
 
 func (db *DBConnection) GetBalanceInfo(loginID int) RetryFunc {
 	return func() (interface{}, error) {
-		query := `SELECT current_balance, balance_withdrawn 
+		query := `SELECT current_balance, held, balance_withdrawn 
 		FROM GophermartUsers 
 		WHERE id=$1`
 		res, err := db.conn.Query(query, loginID)
 		if err != nil {
 			return nil, err
 		}
+		defer res.Close()
 		bInfo := BalanceInfo{}
 		for res.Next() {
-			err := res.Scan(&bInfo.Current, &bInfo.Withdrawn)
+			err := res.Scan(&bInfo.Current, &bInfo.Held, &bInfo.Withdrawn)
 			if err != nil {
 				return nil, err
 			}
 		}
+		bInfo.Available = bInfo.Current - bInfo.Held
 		return &bInfo, nil
 	}
 }
 
+// lockBalance блокирует строку пользователя до конца транзакции и возвращает его баланс и сумму, удержанную под холды.
+// Операции, уменьшающие баланс, сравнивают доступный остаток current-held с суммой только после этой блокировки,
+// поэтому баланс не уходит в минус и не задевает удержанные баллы.
+func lockBalance(tx *pgx.Tx, loginID int) (current, held float32, err error) {
+	query := `SELECT current_balance, held 
+	FROM GophermartUsers 
+	WHERE id=$1 
+	FOR UPDATE`
+	err = tx.QueryRow(query, loginID).Scan(&current, &held)
+	return current, held, err
+}
+
+// WithdrawBalance в одной транзакции списывает sum в счёт заказа order и гасит партии баллов, начиная с самых старых.
+// Возвращает false, если доступного баланса не хватает.
 func (db *DBConnection) WithdrawBalance(loginID int, order string, sum float32) RetryFunc {
 	return func() (interface{}, error) {
-		query := `SELECT current_balance, balance_withdrawn 
-		FROM GophermartUsers 
-		WHERE id=$1`
-		res, err := db.conn.Query(query, loginID)
+		tx, err := db.conn.Begin()
 		if err != nil {
 			return nil, err
 		}
-		bInfo := BalanceInfo{}
-		for res.Next() {
-			err := res.Scan(&bInfo.Current, &bInfo.Withdrawn)
-			if err != nil {
-				return nil, err
-			}
+		defer tx.Rollback()
+
+		current, held, err := lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
 		}
-		if bInfo.Current < sum {
+		if current-held < sum {
 			return false, nil
 		}
-		query = `INSERT INTO GophermartOrders 
+
+		now := time.Now().UTC()
+		query := `INSERT INTO GophermartOrders 
 		(login_id, number, status, accrual, withdrawn, uploaded_at) 
 		VALUES($1, $2, 'NEW', 0, $3, $4)`
-		res2, err := db.conn.Exec(query, loginID, order, sum, time.Now().UTC())
+		res, err := tx.Exec(query, loginID, order, sum, now)
 		if err != nil {
 			return nil, err
 		}
-		sugar.Infoln(res2)
+		sugar.Infoln(res)
 
 		query = `UPDATE GophermartUsers 
-		SET current_balance=$1, balance_withdrawn=$2
-		WHERE id=$3`
-		res3, err := db.conn.Exec(query, bInfo.Current-sum, bInfo.Withdrawn+sum, loginID)
+		SET current_balance=current_balance-$1, balance_withdrawn=balance_withdrawn+$1, 
+			data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		res, err = tx.Exec(query, sum, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		_, err = consumePointLots(tx, loginID, float64(current), float64(sum))
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
 		if err != nil {
 			return nil, err
 		}
-		sugar.Infoln(res3)
 		return true, nil
 	}
 }
@@ -361,30 +907,2448 @@ type WithdrawalsInfo struct {
 	Order       string  `json:"order"`
 	Sum         float32 `json:"sum"`
 	ProcessedAt string  `json:"processed_at"`
+	// Reversed — сколько баллов вернулось пользователю после отмены заказа.
+	Reversed   float32 `json:"reversed,omitempty"`
+	ReversedAt string  `json:"reversed_at,omitempty"`
 }
 
-func (db *DBConnection) GetWithdrawalsInfo(loginID int) RetryFunc {
+type WithdrawalsFilter struct {
+	PageParams
+	MinSum *float32
+	MaxSum *float32
+}
+
+type WithdrawalsPage struct {
+	Withdrawals []WithdrawalsInfo
+	Next        *PageCursor
+	TotalCount  int
+	TotalSum    float64
+}
+
+func (db *DBConnection) GetWithdrawalsInfo(loginID int, filter *WithdrawalsFilter) RetryFunc {
 	return func() (interface{}, error) {
-		var withdrawals []WithdrawalsInfo
-		query := `SELECT number, withdrawn, uploaded_at 
+		var page WithdrawalsPage
+		args := []interface{}{loginID}
+		// Заказы без списания — это только начисления, в историю списаний и её итоги они не попадают.
+		where := ` 
 		FROM GophermartOrders
+		WHERE login_id=$1 AND withdrawn>0`
+		if filter.MinSum != nil {
+			args = append(args, *filter.MinSum)
+			where += fmt.Sprintf(" AND withdrawn>=$%d", len(args))
+		}
+		if filter.MaxSum != nil {
+			args = append(args, *filter.MaxSum)
+			where += fmt.Sprintf(" AND withdrawn<=$%d", len(args))
+		}
+		rangeParams := filter.PageParams
+		rangeParams.Cursor = nil
+		rangeConditions, rangeArgs := pageConditions(&rangeParams, "uploaded_at", args)
+
+		query := `SELECT COUNT(*), COALESCE(SUM(withdrawn), 0)` + where + rangeConditions
+		err := db.conn.QueryRow(query, rangeArgs...).Scan(&page.TotalCount, &page.TotalSum)
+		if err != nil {
+			return nil, err
+		}
+
+		var conditions, order string
+		conditions, args = pageConditions(&filter.PageParams, "uploaded_at", args)
+		order, args = pageOrder(&filter.PageParams, "uploaded_at", args)
+		query = `SELECT id, number, withdrawn, uploaded_at, 
+			(SELECT SUM(sum) FROM GophermartReversals r WHERE r.order_id=GophermartOrders.id), 
+			(SELECT MAX(processed_at) FROM GophermartReversals r WHERE r.order_id=GophermartOrders.id)` + where + conditions + order
+		res, err := db.conn.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		var last PageCursor
+		for res.Next() {
+			if filter.Limit > 0 && len(page.Withdrawals) == filter.Limit {
+				res.Close()
+				page.Next = &PageCursor{At: last.At, ID: last.ID}
+				break
+			}
+			var withdrawal WithdrawalsInfo
+			var myTime, reversedAt pgtype.Timestamptz
+			var reversed pgtype.Float8
+			err := res.Scan(&last.ID, &withdrawal.Order, &withdrawal.Sum, &myTime, &reversed, &reversedAt)
+			if err != nil {
+				return nil, err
+			}
+			last.At = myTime.Time
+			withdrawal.ProcessedAt = myTime.Time.Format(time.RFC3339)
+			if reversedAt.Status == pgtype.Present {
+				withdrawal.Reversed = float32(reversed.Float)
+				withdrawal.ReversedAt = reversedAt.Time.Format(time.RFC3339)
+			}
+			page.Withdrawals = append(page.Withdrawals, withdrawal)
+		}
+
+		return &page, nil
+	}
+}
+
+type AdjustmentInfo struct {
+	Sum         float32 `json:"sum"`
+	Reason      string  `json:"reason"`
+	Comment     string  `json:"comment"`
+	AdminID     int     `json:"admin_id,omitempty"`
+	ProcessedAt string  `json:"processed_at"`
+}
+
+// AdjustBalance в одной транзакции меняет баланс пользователя на sum (списание при sum < 0)
+// и записывает корректировку. Начисление заводит партию со сроком expiresAt, списание гасит старые партии.
+// Возвращает false, если доступного баланса не хватает для списания.
+func (db *DBConnection) AdjustBalance(loginID, adminID int, sum float32, reason, comment string, expiresAt *time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		current, held, err := lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+		if sum < 0 && current-held+sum < 0 {
+			return false, nil
+		}
+
+		query := `UPDATE GophermartUsers 
+		SET current_balance=current_balance+$1, data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		res, err := tx.Exec(query, sum, loginID, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `INSERT INTO GophermartAdjustments 
+		(login_id, admin_id, sum, reason, comment, processed_at) 
+		VALUES($1, $2, $3, $4, $5, $6)`
+		res, err = tx.Exec(query, loginID, adminID, sum, reason, comment, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		if sum > 0 {
+			err = insertPointLot(tx, loginID, PointLotAdjustment, "", float64(sum), time.Now().UTC(), expiresAt)
+		} else {
+			_, err = consumePointLots(tx, loginID, float64(current), float64(-sum))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+}
+
+func (db *DBConnection) GetAdjustmentsInfo(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		var adjustments []AdjustmentInfo
+		query := `SELECT sum, reason, comment, admin_id, processed_at 
+		FROM GophermartAdjustments 
 		WHERE login_id=$1 
-		ORDER BY uploaded_at DESC`
+		ORDER BY processed_at DESC`
 		res, err := db.conn.Query(query, loginID)
 		if err != nil {
 			return nil, err
 		}
+		defer res.Close()
 		for res.Next() {
-			var withdrawal WithdrawalsInfo
+			var adjustment AdjustmentInfo
 			var myTime pgtype.Timestamptz
-			err := res.Scan(&withdrawal.Order, &withdrawal.Sum, &myTime)
+			err := res.Scan(&adjustment.Sum, &adjustment.Reason, &adjustment.Comment, &adjustment.AdminID, &myTime)
 			if err != nil {
 				return nil, err
 			}
-			withdrawal.ProcessedAt = myTime.Time.Format(time.RFC3339)
-			withdrawals = append(withdrawals, withdrawal)
+			adjustment.ProcessedAt = myTime.Time.Format(time.RFC3339)
+			adjustments = append(adjustments, adjustment)
+		}
+
+		return &adjustments, nil
+	}
+}
+
+// Типы строк выписки.
+const (
+	StatementAccrual    = "accrual"
+	StatementWithdrawal = "withdrawal"
+	StatementAdjustment = "adjustment"
+	StatementExpiration = "expiration"
+	StatementBonus      = "bonus"
+	StatementReferral   = "referral"
+	StatementTransfer   = "transfer"
+	StatementReversal   = "reversal"
+)
+
+// statementEntriesQuery собирает все движения баллов пользователя $1 со знаком:
+// начисления по обработанным заказам, бонусы акций и реферальной программы, списания и их отмены, ручные корректировки и сгорание баллов.
+// Реферальный бонус пригласившего показывается с логином приглашённого в reason, перевод — с логином другой стороны.
+const statementEntriesQuery = `SELECT 'accrual' AS type, id, number, '' AS reason, accrual AS amount, 
+			COALESCE(status_changed_at, uploaded_at) AS at 
+		FROM GophermartOrders 
+		WHERE login_id=$1 AND status='PROCESSED' AND accrual>0 
+		UNION ALL 
+		SELECT 'withdrawal', id, number, '', -withdrawn, uploaded_at 
+		FROM GophermartOrders 
+		WHERE login_id=$1 AND withdrawn>0 
+		UNION ALL 
+		SELECT 'reversal', r.id, o.number, r.reason, r.sum, r.processed_at 
+		FROM GophermartReversals r JOIN GophermartOrders o ON o.id=r.order_id 
+		WHERE r.login_id=$1 
+		UNION ALL 
+		SELECT 'adjustment', id, '', reason, sum, processed_at 
+		FROM GophermartAdjustments 
+		WHERE login_id=$1 
+		UNION ALL 
+		SELECT 'expiration', e.id, COALESCE(l.number, ''), '', -e.sum, e.processed_at 
+		FROM GophermartExpirations e JOIN GophermartPointLots l ON l.id=e.lot_id 
+		WHERE e.login_id=$1 
+		UNION ALL 
+		SELECT 'bonus', b.id, b.number, c.name, b.amount, b.credited_at 
+		FROM GophermartCampaignBonuses b JOIN GophermartCampaigns c ON c.id=b.campaign_id 
+		WHERE b.login_id=$1 
+		UNION ALL 
+		SELECT 'referral', id, number, '', referred_bonus, credited_at 
+		FROM GophermartReferralBonuses 
+		WHERE referred_id=$1 
+		UNION ALL 
+		SELECT 'referral', r.id, '', u.login, r.referrer_bonus, r.credited_at 
+		FROM GophermartReferralBonuses r JOIN GophermartUsers u ON u.id=r.referred_id 
+		WHERE r.referrer_id=$1 AND r.referrer_bonus>0 
+		UNION ALL 
+		SELECT 'transfer', t.id, '', u.login, -t.sum, t.completed_at 
+		FROM GophermartTransfers t JOIN GophermartUsers u ON u.id=t.to_id 
+		WHERE t.from_id=$1 AND t.status='completed' 
+		UNION ALL 
+		SELECT 'transfer', t.id, '', u.login, t.sum, t.completed_at 
+		FROM GophermartTransfers t JOIN GophermartUsers u ON u.id=t.from_id 
+		WHERE t.to_id=$1 AND t.status='completed'`
+
+// StatementEntry — одна операция выписки. Amount отрицателен для списаний.
+type StatementEntry struct {
+	Type   string
+	Order  string
+	Reason string
+	Amount float64
+	At     time.Time
+}
+
+// StreamStatement передаёт в opening остаток на момент from, а затем в entry — операции за [from, to) по времени.
+// Оба запроса выполняются в одной транзакции REPEATABLE READ, поэтому остаток согласован с операциями.
+// Метод не возвращает RetryFunc: повтор после частично отправленной выписки продублировал бы строки.
+func (db *DBConnection) StreamStatement(ctx context.Context, loginID int, from, to time.Time,
+	opening func(balance float64) error, entry func(*StatementEntry) error) error {
+	tx, err := db.conn.BeginEx(ctx, &pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT COALESCE(SUM(amount), 0) 
+	FROM (` + statementEntriesQuery + `) entries 
+	WHERE at<$2`
+	var balance float64
+	err = tx.QueryRowEx(ctx, query, nil, loginID, from).Scan(&balance)
+	if err != nil {
+		return err
+	}
+	err = opening(balance)
+	if err != nil {
+		return err
+	}
+
+	query = `SELECT type, number, reason, amount, at 
+	FROM (` + statementEntriesQuery + `) entries 
+	WHERE at>=$2 AND at<$3 
+	ORDER BY at, type, id`
+	res, err := tx.QueryEx(ctx, query, nil, loginID, from, to)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for res.Next() {
+		var e StatementEntry
+		var myTime pgtype.Timestamptz
+		err := res.Scan(&e.Type, &e.Order, &e.Reason, &e.Amount, &myTime)
+		if err != nil {
+			return err
+		}
+		e.At = myTime.Time
+		err = entry(&e)
+		if err != nil {
+			return err
+		}
+	}
+	return res.Err()
+}
+
+// GetBalanceAt восстанавливает баланс на момент at по истории операций: операции в сам момент at учитываются.
+// Холды в истории не хранятся, поэтому весь восстановленный баланс считается доступным.
+func (db *DBConnection) GetBalanceAt(loginID int, at time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		query := `SELECT COALESCE(SUM(amount), 0), 
+			COALESCE(SUM(-amount) FILTER (WHERE type='withdrawal'), 0)-COALESCE(SUM(amount) FILTER (WHERE type='reversal'), 0) 
+		FROM (` + statementEntriesQuery + `) entries 
+		WHERE at<=$2`
+		bInfo := BalanceInfo{}
+		err := db.conn.QueryRow(query, loginID, at).Scan(&bInfo.Current, &bInfo.Withdrawn)
+		if err != nil {
+			return nil, err
+		}
+		bInfo.Available = bInfo.Current
+		return &bInfo, nil
+	}
+}
+
+// Источники партий баллов.
+const (
+	PointLotAccrual    = "accrual"
+	PointLotAdjustment = "adjustment"
+	PointLotBonus      = "bonus"
+	PointLotReferral   = "referral"
+	PointLotTransfer   = "transfer"
+	PointLotReversal   = "reversal"
+)
+
+// insertPointLot заводит партию начисленных баллов. Партии нужны, чтобы сжигать баллы по сроку
+// и гасить их при списании в порядке начисления.
+func insertPointLot(tx *pgx.Tx, loginID int, source, orderNum string, amount float64, accruedAt time.Time, expiresAt *time.Time) error {
+	query := `INSERT INTO GophermartPointLots 
+	(login_id, source, number, amount, remaining, accrued_at, expires_at) 
+	VALUES($1, $2, NULLIF($3, ''), $4, $4, $5, $6)`
+	res, err := tx.Exec(query, loginID, source, orderNum, amount, accruedAt, expiresAt)
+	if err != nil {
+		return err
+	}
+	sugar.Infoln(res)
+	return nil
+}
+
+// consumePointLots гасит sum баллов в партиях пользователя, начиная с самых старых. balance — баланс до списания.
+// Баллы, начисленные до появления партий, в них не учтены; они считаются самыми старыми и тратятся первыми.
+// Возвращает ближайший срок сгорания среди затронутых партий или nil, если все они бессрочные.
+// Вызывается в транзакции, которая уже держит блокировку строки пользователя.
+func consumePointLots(tx *pgx.Tx, loginID int, balance, sum float64) (*time.Time, error) {
+	query := `SELECT COALESCE(SUM(remaining), 0) 
+	FROM GophermartPointLots 
+	WHERE login_id=$1 AND remaining>0`
+	var inLots float64
+	err := tx.QueryRow(query, loginID).Scan(&inLots)
+	if err != nil {
+		return nil, err
+	}
+	fromLots := sum
+	if untracked := balance - inLots; untracked > 0 {
+		fromLots -= untracked
+	}
+	if fromLots <= 0 {
+		return nil, nil
+	}
+
+	query = `WITH consumed AS (UPDATE GophermartPointLots l 
+		SET remaining=GREATEST(o.running-$2, 0) 
+		FROM (SELECT id, remaining, SUM(remaining) OVER (ORDER BY accrued_at, id) AS running 
+			FROM GophermartPointLots 
+			WHERE login_id=$1 AND remaining>0) o 
+		WHERE l.id=o.id AND o.running-o.remaining<$2 
+		RETURNING l.expires_at) 
+	SELECT MIN(expires_at) FROM consumed`
+	var expiresAt pgtype.Timestamptz
+	err = tx.QueryRow(query, loginID, fromLots).Scan(&expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Status != pgtype.Present {
+		return nil, nil
+	}
+	return &expiresAt.Time, nil
+}
+
+// GetUsersWithExpiredPoints возвращает пользователей, у которых есть партии с истёкшим к now сроком.
+func (db *DBConnection) GetUsersWithExpiredPoints(now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		var loginIDs []int
+		query := `SELECT DISTINCT login_id 
+		FROM GophermartPointLots 
+		WHERE remaining>0 AND expires_at<=$1`
+		res, err := db.conn.Query(query, now)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var loginID int
+			err := res.Scan(&loginID)
+			if err != nil {
+				return nil, err
+			}
+			loginIDs = append(loginIDs, loginID)
+		}
+		return loginIDs, res.Err()
+	}
+}
+
+type PointsExpiry struct {
+	Expired float64
+	// Released — холды, снятые из-за того, что после сгорания баллов их стало нечем покрыть.
+	Released []Hold
+}
+
+// ExpirePoints сжигает остатки истёкших к now партий пользователя, записывает по каждой партии
+// строку в GophermartExpirations и уменьшает баланс. Если оставшийся баланс меньше удержанного,
+// снимает холды, начиная с новых, пока доступный баланс не станет неотрицательным.
+func (db *DBConnection) ExpirePoints(loginID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		current, held, err := lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+
+		query := `WITH due AS (
+			SELECT id, remaining 
+			FROM GophermartPointLots 
+			WHERE login_id=$1 AND remaining>0 AND expires_at<=$2), 
+		expired AS (
+			UPDATE GophermartPointLots l 
+			SET remaining=0, expired_at=$2 
+			FROM due 
+			WHERE l.id=due.id) 
+		INSERT INTO GophermartExpirations (login_id, lot_id, sum, processed_at) 
+		SELECT $1, id, remaining, $2 FROM due 
+		RETURNING sum`
+		res, err := tx.Query(query, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		var expiry PointsExpiry
+		for res.Next() {
+			var sum float64
+			err := res.Scan(&sum)
+			if err != nil {
+				res.Close()
+				return nil, err
+			}
+			expiry.Expired += sum
+		}
+		res.Close()
+		if res.Err() != nil {
+			return nil, res.Err()
+		}
+		if expiry.Expired == 0 {
+			return &expiry, nil
+		}
+
+		query = `UPDATE GophermartUsers 
+		SET current_balance=GREATEST(current_balance-$1, 0), data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		res2, err := tx.Exec(query, expiry.Expired, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res2)
+
+		remaining := float64(current) - expiry.Expired
+		if float64(held) > remaining {
+			expiry.Released, err = releaseUncoveredHolds(tx, loginID, float64(held), remaining, now)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
 		}
+		return &expiry, nil
+	}
+}
 
-		return &withdrawals, nil
+// releaseUncoveredHolds снимает действующие холды, начиная с новых, пока удержанное held не уместится в balance.
+// Вызывается в транзакции, которая уже держит блокировку строки пользователя.
+func releaseUncoveredHolds(tx *pgx.Tx, loginID int, held, balance float64, now time.Time) ([]Hold, error) {
+	query := holdsQuery + ` 
+	WHERE login_id=$1 AND status='held' 
+	ORDER BY created_at DESC, id DESC 
+	FOR UPDATE`
+	res, err := tx.Query(query, loginID)
+	if err != nil {
+		return nil, err
+	}
+	var holds []Hold
+	for res.Next() {
+		hold, err := scanHold(res)
+		if err != nil {
+			res.Close()
+			return nil, err
+		}
+		holds = append(holds, *hold)
+	}
+	res.Close()
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var released []Hold
+	for i := range holds {
+		if roundPoints(held) <= roundPoints(balance) {
+			break
+		}
+		err = resolveHold(tx, loginID, &holds[i], HoldReleased, now)
+		if err != nil {
+			return nil, err
+		}
+		held -= holds[i].Sum
+		released = append(released, holds[i])
+	}
+	return released, nil
+}
+
+type ExpiringPoints struct {
+	Amount    float64 `json:"amount"`
+	ExpiresAt string  `json:"expires_at"`
+}
+
+// GetExpiringPoints возвращает ближайшие limit сроков сгорания с суммами, которые сгорят в каждый из них.
+func (db *DBConnection) GetExpiringPoints(loginID, limit int) RetryFunc {
+	return func() (interface{}, error) {
+		var expiring []ExpiringPoints
+		query := `SELECT expires_at, SUM(remaining) 
+		FROM GophermartPointLots 
+		WHERE login_id=$1 AND remaining>0 AND expires_at IS NOT NULL 
+		GROUP BY expires_at 
+		ORDER BY expires_at 
+		LIMIT $2`
+		res, err := db.conn.Query(query, loginID, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var e ExpiringPoints
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&myTime, &e.Amount)
+			if err != nil {
+				return nil, err
+			}
+			e.ExpiresAt = myTime.Time.Format(time.RFC3339)
+			expiring = append(expiring, e)
+		}
+		return expiring, res.Err()
+	}
+}
+
+type APIKeyInfo struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedBy int      `json:"created_by"`
+	CreatedAt string   `json:"created_at"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+}
+
+func (db *DBConnection) CreateAPIKey(name string, scopes []string, createdBy int, keyHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartAPIKeys 
+		(name, key_hash, scopes, created_by, created_at) 
+		VALUES($1, $2, $3, $4, $5) 
+		RETURNING id`
+		var keyID int
+		err := db.conn.QueryRow(query, name, keyHash, strings.Join(scopes, ","), createdBy, time.Now().UTC()).Scan(&keyID)
+		if err != nil {
+			return nil, err
+		}
+		return keyID, nil
+	}
+}
+
+func (db *DBConnection) GetAPIKeys() RetryFunc {
+	return func() (interface{}, error) {
+		var keys []APIKeyInfo
+		query := `SELECT id, name, scopes, created_by, created_at, revoked_at 
+		FROM GophermartAPIKeys 
+		ORDER BY created_at ASC`
+		res, err := db.conn.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var key APIKeyInfo
+			var scopes string
+			var createdAt, revokedAt pgtype.Timestamptz
+			err := res.Scan(&key.ID, &key.Name, &scopes, &key.CreatedBy, &createdAt, &revokedAt)
+			if err != nil {
+				return nil, err
+			}
+			key.Scopes = strings.Split(scopes, ",")
+			key.CreatedAt = createdAt.Time.Format(time.RFC3339)
+			if revokedAt.Status == pgtype.Present {
+				key.RevokedAt = revokedAt.Time.Format(time.RFC3339)
+			}
+			keys = append(keys, key)
+		}
+
+		return &keys, nil
+	}
+}
+
+// RevokeAPIKey возвращает false, если активного ключа с таким id нет.
+func (db *DBConnection) RevokeAPIKey(keyID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartAPIKeys 
+		SET revoked_at=$1
+		WHERE id=$2 AND revoked_at IS NULL`
+		res, err := db.conn.Exec(query, time.Now().UTC(), keyID)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+// CheckAPIKey возвращает активный ключ по хешу или nil, если такого ключа нет.
+func (db *DBConnection) CheckAPIKey(keyHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `SELECT id, name, scopes 
+		FROM GophermartAPIKeys 
+		WHERE key_hash=$1 AND revoked_at IS NULL`
+		var key ServiceKey
+		var scopes string
+		err := db.conn.QueryRow(query, keyHash).Scan(&key.ID, &key.Name, &scopes)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return (*ServiceKey)(nil), nil
+			}
+			return nil, err
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		return &key, nil
+	}
+}
+
+type TOTPInfo struct {
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+	// FailedAttempts — неверные коды с момента FailuresSince.
+	FailedAttempts int
+	FailuresSince  time.Time
+}
+
+// GetTOTP возвращает настройки второго фактора пользователя или nil, если он не подключался.
+func (db *DBConnection) GetTOTP(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `SELECT secret, confirmed, last_step, failed_attempts, failures_since 
+		FROM GophermartTOTP 
+		WHERE login_id=$1`
+		var info TOTPInfo
+		var failuresSince pgtype.Timestamptz
+		err := db.conn.QueryRow(query, loginID).
+			Scan(&info.Secret, &info.Confirmed, &info.LastStep, &info.FailedAttempts, &failuresSince)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return (*TOTPInfo)(nil), nil
+			}
+			return nil, err
+		}
+		if failuresSince.Status == pgtype.Present {
+			info.FailuresSince = failuresSince.Time
+		}
+		return &info, nil
+	}
+}
+
+// SaveTOTPSecret записывает новый неподтверждённый секрет.
+// Возвращает false, если у пользователя уже подключён подтверждённый второй фактор.
+func (db *DBConnection) SaveTOTPSecret(loginID int, secret string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartTOTP 
+		(login_id, secret, confirmed, last_step) 
+		VALUES ($1, $2, false, 0)
+		ON CONFLICT (login_id) 
+		DO UPDATE SET secret=$2, last_step=0 
+		WHERE GophermartTOTP.confirmed=false`
+		res, err := db.conn.Exec(query, loginID, secret)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+// ConfirmTOTP включает второй фактор, заменяет коды восстановления пользователя и отзывает его токен:
+// сессии, открытые только по паролю, после этого недействительны.
+func (db *DBConnection) ConfirmTOTP(loginID int, step int64, codeHashes []string) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `UPDATE GophermartTOTP 
+		SET confirmed=true, last_step=$1
+		WHERE login_id=$2 AND confirmed=false`
+		res, err := tx.Exec(query, step, loginID)
+		if err != nil {
+			return nil, err
+		}
+		if res.RowsAffected() == 0 {
+			return false, nil
+		}
+
+		query = `DELETE FROM GophermartRecoveryCodes WHERE login_id=$1`
+		_, err = tx.Exec(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		query = `INSERT INTO GophermartRecoveryCodes 
+		(login_id, code_hash) 
+		VALUES ($1, $2)`
+		for _, hash := range codeHashes {
+			_, err = tx.Exec(query, loginID, hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = tx.Exec(`DELETE FROM GophermartAuthentications WHERE login_id=$1`, loginID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+}
+
+// FailSecondFactor засчитывает неверный код второго фактора. Счётчик начинается заново,
+// если первая неудача текущего окна была раньше windowStart.
+func (db *DBConnection) FailSecondFactor(loginID int, now, windowStart time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartTOTP 
+		SET failed_attempts=CASE WHEN failures_since>$2 THEN failed_attempts+1 ELSE 1 END, 
+			failures_since=CASE WHEN failures_since>$2 THEN failures_since ELSE $3 END
+		WHERE login_id=$1`
+		_, err := db.conn.Exec(query, loginID, windowStart, now)
+		return nil, err
+	}
+}
+
+// UseTOTPStep запоминает использованный шаг. Возвращает false, если код этого шага уже принимался.
+func (db *DBConnection) UseTOTPStep(loginID int, step int64) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartTOTP 
+		SET last_step=$1
+		WHERE login_id=$2 AND last_step<$1`
+		res, err := db.conn.Exec(query, step, loginID)
+		if err != nil {
+			return nil, err
+		}
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+// UseRecoveryCode гасит код восстановления. Возвращает false, если кода нет или он уже использован.
+func (db *DBConnection) UseRecoveryCode(loginID int, codeHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartRecoveryCodes 
+		SET used_at=$1
+		WHERE login_id=$2 AND code_hash=$3 AND used_at IS NULL`
+		res, err := db.conn.Exec(query, time.Now().UTC(), loginID, codeHash)
+		if err != nil {
+			return nil, err
+		}
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+func (db *DBConnection) DeleteTOTP(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`DELETE FROM GophermartRecoveryCodes WHERE login_id=$1`, loginID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`DELETE FROM GophermartTOTP WHERE login_id=$1`, loginID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+}
+
+type LoginChallenge struct {
+	LoginID  int
+	Login    string
+	Hash     string
+	Attempts int
+}
+
+func (db *DBConnection) CreateLoginChallenge(loginID int, tokenHash string, expiresAt time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartLoginChallenges 
+		(login_id, token_hash, attempts, expires_at) 
+		VALUES ($1, $2, 0, $3)`
+		res, err := db.conn.Exec(query, loginID, tokenHash, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return nil, nil
+	}
+}
+
+// GetLoginChallenge возвращает действующий вызов второго фактора или nil, если он не найден или истёк.
+func (db *DBConnection) GetLoginChallenge(tokenHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `SELECT c.login_id, u.login, u.password_hash, c.attempts 
+		FROM GophermartLoginChallenges c 
+		JOIN GophermartUsers u ON u.id=c.login_id 
+		WHERE c.token_hash=$1 AND c.expires_at>$2`
+		var challenge LoginChallenge
+		err := db.conn.QueryRow(query, tokenHash, time.Now().UTC()).
+			Scan(&challenge.LoginID, &challenge.Login, &challenge.Hash, &challenge.Attempts)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return (*LoginChallenge)(nil), nil
+			}
+			return nil, err
+		}
+		return &challenge, nil
+	}
+}
+
+func (db *DBConnection) FailLoginChallenge(tokenHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartLoginChallenges 
+		SET attempts=attempts+1
+		WHERE token_hash=$1`
+		_, err := db.conn.Exec(query, tokenHash)
+		return nil, err
+	}
+}
+
+func (db *DBConnection) DeleteLoginChallenge(tokenHash string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `DELETE FROM GophermartLoginChallenges 
+		WHERE token_hash=$1 OR expires_at<$2`
+		_, err := db.conn.Exec(query, tokenHash, time.Now().UTC())
+		return nil, err
+	}
+}
+
+func (db *DBConnection) InsertEvent(loginID int, eventType, data string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartEvents 
+		(login_id, type, data, created_at) 
+		VALUES($1, $2, $3, $4) 
+		RETURNING id`
+		var eventID int
+		err := db.conn.QueryRow(query, loginID, eventType, data, time.Now().UTC()).Scan(&eventID)
+		if err != nil {
+			return nil, err
+		}
+		return eventID, nil
+	}
+}
+
+// GetEventsAfter возвращает не больше limit событий пользователя с id больше afterID для возобновления потока.
+func (db *DBConnection) GetEventsAfter(loginID, afterID, limit int) RetryFunc {
+	return func() (interface{}, error) {
+		var events []Event
+		query := `SELECT id, type, data 
+		FROM GophermartEvents 
+		WHERE login_id=$1 AND id>$2 
+		ORDER BY id ASC 
+		LIMIT $3`
+		res, err := db.conn.Query(query, loginID, afterID, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			event := Event{LoginID: loginID}
+			err := res.Scan(&event.ID, &event.Type, &event.Data)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+
+		return &events, nil
+	}
+}
+
+type WebhookInfo struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	CreatedAt string `json:"created_at"`
+}
+
+func (db *DBConnection) CreateWebhook(loginID int, url, secret string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartWebhooks 
+		(login_id, url, secret, created_at) 
+		VALUES($1, $2, $3, $4) 
+		RETURNING id`
+		var webhookID int
+		err := db.conn.QueryRow(query, loginID, url, secret, time.Now().UTC()).Scan(&webhookID)
+		if err != nil {
+			return nil, err
+		}
+		return webhookID, nil
+	}
+}
+
+func (db *DBConnection) GetWebhooks(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		var webhooks []WebhookInfo
+		query := `SELECT id, url, created_at 
+		FROM GophermartWebhooks 
+		WHERE login_id=$1 
+		ORDER BY id ASC`
+		res, err := db.conn.Query(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var webhook WebhookInfo
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&webhook.ID, &webhook.URL, &myTime)
+			if err != nil {
+				return nil, err
+			}
+			webhook.CreatedAt = myTime.Time.Format(time.RFC3339)
+			webhooks = append(webhooks, webhook)
+		}
+
+		return &webhooks, nil
+	}
+}
+
+// DeleteWebhook возвращает false, если у пользователя нет такого вебхука.
+func (db *DBConnection) DeleteWebhook(loginID, webhookID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `DELETE FROM GophermartWebhooks 
+		WHERE id=$1 AND login_id=$2`
+		res, err := db.conn.Exec(query, webhookID, loginID)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+// EnqueueWebhookDeliveries ставит в очередь доставку события на все вебхуки пользователя.
+func (db *DBConnection) EnqueueWebhookDeliveries(loginID int, eventType, data string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `INSERT INTO GophermartWebhookDeliveries 
+		(webhook_id, event_type, data, status, attempts, next_attempt_at, created_at) 
+		SELECT id, $2, $3, 'pending', 0, $4, $4 
+		FROM GophermartWebhooks 
+		WHERE login_id=$1`
+		res, err := db.conn.Exec(query, loginID, eventType, data, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return nil, nil
+	}
+}
+
+type WebhookDelivery struct {
+	ID        int
+	URL       string
+	Secret    string
+	EventType string
+	Data      string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+func (db *DBConnection) GetDueWebhookDeliveries(limit int) RetryFunc {
+	return func() (interface{}, error) {
+		var deliveries []WebhookDelivery
+		query := `SELECT d.id, w.url, w.secret, d.event_type, d.data, d.attempts, d.created_at 
+		FROM GophermartWebhookDeliveries d 
+		JOIN GophermartWebhooks w ON w.id=d.webhook_id 
+		WHERE d.status='pending' AND d.next_attempt_at<=$1 
+		ORDER BY d.next_attempt_at ASC 
+		LIMIT $2`
+		res, err := db.conn.Query(query, time.Now().UTC(), limit)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var delivery WebhookDelivery
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.EventType,
+				&delivery.Data, &delivery.Attempts, &myTime)
+			if err != nil {
+				return nil, err
+			}
+			delivery.CreatedAt = myTime.Time
+			deliveries = append(deliveries, delivery)
+		}
+
+		return &deliveries, nil
+	}
+}
+
+// RecordWebhookAttempt пишет попытку доставки в журнал и переводит доставку в status.
+// nextAttemptAt используется только для статуса pending.
+func (db *DBConnection) RecordWebhookAttempt(deliveryID, responseCode int, errText, status string, nextAttemptAt time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		var code, errValue interface{}
+		if responseCode != 0 {
+			code = responseCode
+		}
+		if errText != "" {
+			errValue = errText
+		}
+		query := `INSERT INTO GophermartWebhookAttempts 
+		(delivery_id, response_code, error, attempted_at) 
+		VALUES($1, $2, $3, $4)`
+		_, err = tx.Exec(query, deliveryID, code, errValue, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+
+		query = `UPDATE GophermartWebhookDeliveries 
+		SET status=$1, attempts=attempts+1, last_response_code=$2, next_attempt_at=$3 
+		WHERE id=$4`
+		_, err = tx.Exec(query, status, code, nextAttemptAt, deliveryID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+}
+
+type WebhookAttemptInfo struct {
+	ResponseCode int    `json:"response_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	AttemptedAt  string `json:"attempted_at"`
+}
+
+type WebhookDeliveryInfo struct {
+	ID               int                  `json:"id"`
+	EventType        string               `json:"event_type"`
+	Status           string               `json:"status"`
+	Attempts         int                  `json:"attempts"`
+	LastResponseCode int                  `json:"last_response_code,omitempty"`
+	CreatedAt        string               `json:"created_at"`
+	Log              []WebhookAttemptInfo `json:"log"`
+}
+
+// GetWebhookDeliveries возвращает доставки вебхука пользователя с журналом попыток. Пустой status — все доставки.
+func (db *DBConnection) GetWebhookDeliveries(loginID, webhookID int, status string) RetryFunc {
+	return func() (interface{}, error) {
+		var deliveries []WebhookDeliveryInfo
+		query := `SELECT d.id, d.event_type, d.status, d.attempts, COALESCE(d.last_response_code, 0), d.created_at 
+		FROM GophermartWebhookDeliveries d 
+		JOIN GophermartWebhooks w ON w.id=d.webhook_id 
+		WHERE w.id=$1 AND w.login_id=$2 AND ($3='' OR d.status=$3) 
+		ORDER BY d.id DESC 
+		LIMIT 100`
+		res, err := db.conn.Query(query, webhookID, loginID, status)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		index := make(map[int]int)
+		var ids []int32
+		for res.Next() {
+			var delivery WebhookDeliveryInfo
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&delivery.ID, &delivery.EventType, &delivery.Status, &delivery.Attempts,
+				&delivery.LastResponseCode, &myTime)
+			if err != nil {
+				return nil, err
+			}
+			delivery.CreatedAt = myTime.Time.Format(time.RFC3339)
+			delivery.Log = []WebhookAttemptInfo{}
+			index[delivery.ID] = len(deliveries)
+			ids = append(ids, int32(delivery.ID))
+			deliveries = append(deliveries, delivery)
+		}
+		if len(deliveries) == 0 {
+			return &deliveries, nil
+		}
+
+		query = `SELECT delivery_id, COALESCE(response_code, 0), COALESCE(error, ''), attempted_at 
+		FROM GophermartWebhookAttempts 
+		WHERE delivery_id=ANY($1) 
+		ORDER BY id ASC`
+		res, err = db.conn.Query(query, ids)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var deliveryID int
+			var attempt WebhookAttemptInfo
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&deliveryID, &attempt.ResponseCode, &attempt.Error, &myTime)
+			if err != nil {
+				return nil, err
+			}
+			attempt.AttemptedAt = myTime.Time.Format(time.RFC3339)
+			i := index[deliveryID]
+			deliveries[i].Log = append(deliveries[i].Log, attempt)
+		}
+
+		return &deliveries, nil
+	}
+}
+
+// RedeliverWebhookDelivery снова ставит завершённую доставку в очередь. Возвращает false,
+// если доставки нет, она чужая или ещё в очереди.
+func (db *DBConnection) RedeliverWebhookDelivery(loginID, webhookID, deliveryID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartWebhookDeliveries d 
+		SET status='pending', attempts=0, next_attempt_at=$4 
+		FROM GophermartWebhooks w 
+		WHERE d.id=$3 AND d.webhook_id=$2 AND w.id=d.webhook_id AND w.login_id=$1 AND d.status<>'pending'`
+		res, err := db.conn.Exec(query, loginID, webhookID, deliveryID, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+// TierStanding — сохранённый уровень пользователя и сумма его начислений за скользящее окно.
+// Пустой Tier означает, что уровень ещё не присваивался.
+type TierStanding struct {
+	LoginID int
+	Tier    string
+	Accrued float64
+}
+
+// tierStandingsQuery считает начисления по обработанным заказам с момента $1.
+const tierStandingsQuery = `SELECT u.id, COALESCE(u.tier, ''), COALESCE(SUM(o.accrual), 0) 
+	FROM GophermartUsers u 
+	LEFT JOIN GophermartOrders o ON o.login_id=u.id AND o.status='PROCESSED' AND o.accrual>0 
+		AND COALESCE(o.status_changed_at, o.uploaded_at)>=$1`
+
+func (db *DBConnection) GetTierStanding(loginID int, since time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		query := tierStandingsQuery + ` 
+		WHERE u.id=$2 
+		GROUP BY u.id`
+		var standing TierStanding
+		err := db.conn.QueryRow(query, since, loginID).Scan(&standing.LoginID, &standing.Tier, &standing.Accrued)
+		if err != nil {
+			return nil, err
+		}
+		return &standing, nil
+	}
+}
+
+// GetTierStandings возвращает положение всех пользователей для периодического пересчёта уровней.
+func (db *DBConnection) GetTierStandings(since time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		var standings []TierStanding
+		query := tierStandingsQuery + ` 
+		GROUP BY u.id`
+		res, err := db.conn.Query(query, since)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var standing TierStanding
+			err := res.Scan(&standing.LoginID, &standing.Tier, &standing.Accrued)
+			if err != nil {
+				return nil, err
+			}
+			standings = append(standings, standing)
+		}
+		return standings, res.Err()
+	}
+}
+
+type TierChange struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Accrued   float64 `json:"accrued"`
+	ChangedAt string  `json:"changed_at"`
+}
+
+// ChangeUserTier присваивает пользователю уровень tier и записывает переход в историю.
+// Незаданный уровень считается равным baseTier. Возвращает nil, если уровень не изменился.
+func (db *DBConnection) ChangeUserTier(loginID int, tier, baseTier string, accrued float64) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `SELECT COALESCE(tier, $2) 
+		FROM GophermartUsers 
+		WHERE id=$1 
+		FOR UPDATE`
+		var current string
+		err = tx.QueryRow(query, loginID, baseTier).Scan(&current)
+		if err != nil {
+			return nil, err
+		}
+		if current == tier {
+			return (*TierChange)(nil), nil
+		}
+
+		now := time.Now().UTC()
+		query = `UPDATE GophermartUsers 
+		SET tier=$1
+		WHERE id=$2`
+		res, err := tx.Exec(query, tier, loginID)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		query = `INSERT INTO GophermartTierChanges 
+		(login_id, from_tier, to_tier, accrued, changed_at) 
+		VALUES($1, $2, $3, $4, $5)`
+		res, err = tx.Exec(query, loginID, current, tier, accrued, now)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &TierChange{From: current, To: tier, Accrued: accrued, ChangedAt: now.Format(time.RFC3339)}, nil
+	}
+}
+
+func (db *DBConnection) GetTierChanges(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		var changes []TierChange
+		query := `SELECT from_tier, to_tier, accrued, changed_at 
+		FROM GophermartTierChanges 
+		WHERE login_id=$1 
+		ORDER BY changed_at DESC, id DESC`
+		res, err := db.conn.Query(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var change TierChange
+			var myTime pgtype.Timestamptz
+			err := res.Scan(&change.From, &change.To, &change.Accrued, &myTime)
+			if err != nil {
+				return nil, err
+			}
+			change.ChangedAt = myTime.Time.Format(time.RFC3339)
+			changes = append(changes, change)
+		}
+		return changes, res.Err()
+	}
+}
+
+type Campaign struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	StartsAt    string   `json:"starts_at"`
+	EndsAt      string   `json:"ends_at"`
+	Multiplier  float64  `json:"multiplier"`
+	Bonus       float64  `json:"bonus"`
+	Tiers       []string `json:"tiers,omitempty"`
+	SegmentSize int      `json:"segment_size"`
+	Budget      *float64 `json:"budget,omitempty"`
+	Spent       float64  `json:"spent"`
+	BonusCount  int      `json:"bonus_count"`
+	CreatedBy   int      `json:"created_by"`
+	CreatedAt   string   `json:"created_at"`
+	DisabledAt  string   `json:"disabled_at,omitempty"`
+}
+
+// CreateCampaign сохраняет акцию и её сегмент. Возвращает id акции или -1, если какого-то логина из logins нет.
+func (db *DBConnection) CreateCampaign(c *CampaignRequest, startsAt, endsAt time.Time, createdBy int) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `INSERT INTO GophermartCampaigns 
+		(name, starts_at, ends_at, multiplier, bonus, tiers, budget, created_by, created_at) 
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) 
+		RETURNING id`
+		var campaignID int
+		err = tx.QueryRow(query, c.Name, startsAt, endsAt, c.Multiplier, c.Bonus, strings.Join(c.Tiers, ","),
+			c.Budget, createdBy, time.Now().UTC()).Scan(&campaignID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(c.Logins) > 0 {
+			query = `INSERT INTO GophermartCampaignUsers (campaign_id, login_id) 
+			SELECT $1, id FROM GophermartUsers WHERE login=ANY($2)`
+			res, err := tx.Exec(query, campaignID, c.Logins)
+			if err != nil {
+				return nil, err
+			}
+			if int(res.RowsAffected()) != len(c.Logins) {
+				return -1, nil
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return campaignID, nil
+	}
+}
+
+const campaignsQuery = `SELECT c.id, c.name, c.starts_at, c.ends_at, c.multiplier, c.bonus, c.tiers, c.budget, c.spent, 
+		(SELECT COUNT(*) FROM GophermartCampaignUsers u WHERE u.campaign_id=c.id), 
+		(SELECT COUNT(*) FROM GophermartCampaignBonuses b WHERE b.campaign_id=c.id), 
+		c.created_by, c.created_at, c.disabled_at 
+	FROM GophermartCampaigns c`
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (*Campaign, error) {
+	var c Campaign
+	var tiers string
+	var budget pgtype.Float8
+	var startsAt, endsAt, createdAt, disabledAt pgtype.Timestamptz
+	err := row.Scan(&c.ID, &c.Name, &startsAt, &endsAt, &c.Multiplier, &c.Bonus, &tiers, &budget, &c.Spent,
+		&c.SegmentSize, &c.BonusCount, &c.CreatedBy, &createdAt, &disabledAt)
+	if err != nil {
+		return nil, err
+	}
+	if tiers != "" {
+		c.Tiers = strings.Split(tiers, ",")
+	}
+	if budget.Status == pgtype.Present {
+		c.Budget = &budget.Float
+	}
+	c.StartsAt = startsAt.Time.Format(time.RFC3339)
+	c.EndsAt = endsAt.Time.Format(time.RFC3339)
+	c.CreatedAt = createdAt.Time.Format(time.RFC3339)
+	if disabledAt.Status == pgtype.Present {
+		c.DisabledAt = disabledAt.Time.Format(time.RFC3339)
+	}
+	return &c, nil
+}
+
+func (db *DBConnection) GetCampaigns() RetryFunc {
+	return func() (interface{}, error) {
+		var campaigns []Campaign
+		query := campaignsQuery + ` 
+		ORDER BY c.starts_at DESC, c.id DESC`
+		res, err := db.conn.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			c, err := scanCampaign(res)
+			if err != nil {
+				return nil, err
+			}
+			campaigns = append(campaigns, *c)
+		}
+		return campaigns, res.Err()
+	}
+}
+
+// GetCampaign возвращает акцию по id или nil, если её нет.
+func (db *DBConnection) GetCampaign(campaignID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := campaignsQuery + ` 
+		WHERE c.id=$1`
+		c, err := scanCampaign(db.conn.QueryRow(query, campaignID))
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return (*Campaign)(nil), nil
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// DisableCampaign останавливает акцию. Начисленные бонусы остаются.
+func (db *DBConnection) DisableCampaign(campaignID int) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartCampaigns 
+		SET disabled_at=$1
+		WHERE id=$2 AND disabled_at IS NULL`
+		res, err := db.conn.Exec(query, time.Now().UTC(), campaignID)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res)
+		return res.RowsAffected() > 0, nil
+	}
+}
+
+type CampaignBonus struct {
+	CampaignID int
+	Campaign   string
+	Amount     float64
+}
+
+// ApplyCampaigns начисляет бонусы всех акций, действующих в момент now и подходящих пользователю
+// по уровню tier и сегменту, за заказ orderNum с начислением accrual. Бонус ограничен остатком бюджета акции
+// и записывается отдельно от начисления системы расчёта. Повторный вызов для того же заказа бонусов не добавляет.
+func (db *DBConnection) ApplyCampaigns(loginID int, orderNum string, accrual float32, tier string,
+	now time.Time, expiresAt *time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `SELECT id 
+		FROM GophermartUsers 
+		WHERE id=$1 
+		FOR UPDATE`
+		var id int
+		err = tx.QueryRow(query, loginID).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		query = `SELECT c.id, c.name, c.multiplier, c.bonus, c.tiers, c.budget, c.spent, 
+			EXISTS (SELECT 1 FROM GophermartCampaignUsers u WHERE u.campaign_id=c.id), 
+			EXISTS (SELECT 1 FROM GophermartCampaignUsers u WHERE u.campaign_id=c.id AND u.login_id=$1) 
+		FROM GophermartCampaigns c 
+		WHERE c.starts_at<=$2 AND c.ends_at>$2 AND c.disabled_at IS NULL 
+			AND (c.budget IS NULL OR c.spent<c.budget) 
+		ORDER BY c.id 
+		FOR UPDATE OF c`
+		res, err := tx.Query(query, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		var bonuses []CampaignBonus
+		for res.Next() {
+			var c Campaign
+			var tiers string
+			var budget pgtype.Float8
+			var segmented, inSegment bool
+			err := res.Scan(&c.ID, &c.Name, &c.Multiplier, &c.Bonus, &tiers, &budget, &c.Spent, &segmented, &inSegment)
+			if err != nil {
+				res.Close()
+				return nil, err
+			}
+			if segmented && !inSegment || tiers != "" && !containsString(strings.Split(tiers, ","), tier) {
+				continue
+			}
+			if budget.Status == pgtype.Present {
+				c.Budget = &budget.Float
+			}
+			amount := c.bonusFor(float64(accrual))
+			if amount > 0 {
+				bonuses = append(bonuses, CampaignBonus{CampaignID: c.ID, Campaign: c.Name, Amount: amount})
+			}
+		}
+		res.Close()
+		if res.Err() != nil {
+			return nil, res.Err()
+		}
+
+		var credited []CampaignBonus
+		var total float64
+		for _, bonus := range bonuses {
+			query = `INSERT INTO GophermartCampaignBonuses 
+			(campaign_id, login_id, number, accrual, amount, credited_at) 
+			VALUES($1, $2, $3, $4, $5, $6) 
+			ON CONFLICT (campaign_id, number) DO NOTHING`
+			res, err := tx.Exec(query, bonus.CampaignID, loginID, orderNum, accrual, bonus.Amount, now)
+			if err != nil {
+				return nil, err
+			}
+			if res.RowsAffected() == 0 {
+				continue
+			}
+			query = `UPDATE GophermartCampaigns 
+			SET spent=spent+$1
+			WHERE id=$2`
+			_, err = tx.Exec(query, bonus.Amount, bonus.CampaignID)
+			if err != nil {
+				return nil, err
+			}
+			err = insertPointLot(tx, loginID, PointLotBonus, orderNum, bonus.Amount, now, expiresAt)
+			if err != nil {
+				return nil, err
+			}
+			credited = append(credited, bonus)
+			total += bonus.Amount
+		}
+		if total == 0 {
+			return credited, nil
+		}
+
+		query = `UPDATE GophermartUsers 
+		SET current_balance=current_balance+$1, data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		res2, err := tx.Exec(query, total, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		sugar.Infoln(res2)
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return credited, nil
+	}
+}
+
+// GetReferralCode возвращает реферальный код пользователя, при первом обращении сохраняя code.
+// Пустая строка означает, что code уже занят другим пользователем и нужно попробовать другой.
+func (db *DBConnection) GetReferralCode(loginID int, code string) RetryFunc {
+	return func() (interface{}, error) {
+		query := `UPDATE GophermartUsers 
+		SET referral_code=COALESCE(referral_code, $2)
+		WHERE id=$1 
+		RETURNING referral_code`
+		var referralCode string
+		err := db.conn.QueryRow(query, loginID, code).Scan(&referralCode)
+		if err != nil {
+			if pgerr, ok := err.(pgx.PgError); ok && pgerr.Code == pgerrcode.UniqueViolation {
+				return "", nil
+			}
+			return nil, err
+		}
+		return referralCode, nil
+	}
+}
+
+const (
+	ReferralPending     = "pending"
+	ReferralCredited    = "credited"
+	ReferralNotEligible = "not_eligible"
+)
+
+type Referral struct {
+	Login        string  `json:"login"`
+	RegisteredAt string  `json:"registered_at"`
+	Status       string  `json:"status"`
+	Bonus        float64 `json:"bonus"`
+	CreditedAt   string  `json:"credited_at,omitempty"`
+}
+
+// GetReferrals возвращает приглашённых пользователем, новые первыми. Бонус пригласившего не начисляется
+// (статус not_eligible), если к первому заказу приглашённого лимит бонусов был исчерпан или пригласивший был отключён.
+func (db *DBConnection) GetReferrals(loginID int) RetryFunc {
+	return func() (interface{}, error) {
+		var referrals []Referral
+		query := `SELECT u.login, u.referred_at, r.referrer_bonus, r.credited_at 
+		FROM GophermartUsers u LEFT JOIN GophermartReferralBonuses r ON r.referred_id=u.id 
+		WHERE u.referred_by=$1 
+		ORDER BY u.referred_at DESC, u.id DESC`
+		res, err := db.conn.Query(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var ref Referral
+			var registeredAt, creditedAt pgtype.Timestamptz
+			var bonus pgtype.Float8
+			err := res.Scan(&ref.Login, &registeredAt, &bonus, &creditedAt)
+			if err != nil {
+				return nil, err
+			}
+			ref.RegisteredAt = registeredAt.Time.Format(time.RFC3339)
+			switch {
+			case creditedAt.Status != pgtype.Present:
+				ref.Status = ReferralPending
+			case bonus.Float > 0:
+				ref.Status = ReferralCredited
+				ref.Bonus = bonus.Float
+				ref.CreditedAt = creditedAt.Time.Format(time.RFC3339)
+			default:
+				ref.Status = ReferralNotEligible
+				ref.CreditedAt = creditedAt.Time.Format(time.RFC3339)
+			}
+			referrals = append(referrals, ref)
+		}
+		return referrals, res.Err()
+	}
+}
+
+type ReferralBonus struct {
+	ReferrerID    int
+	ReferredLogin string
+	ReferrerBonus float64
+	ReferredBonus float64
+}
+
+// CreditReferral начисляет реферальный бонус за первый обработанный заказ orderNum приглашённого пользователя:
+// bonus получают и он, и пригласивший. Пригласивший не получает бонус, если он отключён или уже получил limit бонусов.
+// Возвращает nil, если пользователя никто не приглашал или бонус за него уже начислен.
+func (db *DBConnection) CreditReferral(referredID int, orderNum string, bonus float64, limit int,
+	now time.Time, expiresAt *time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `SELECT referred_by, login 
+		FROM GophermartUsers 
+		WHERE id=$1`
+		var referrerID pgtype.Int4
+		ref := ReferralBonus{ReferredBonus: bonus}
+		err = tx.QueryRow(query, referredID).Scan(&referrerID, &ref.ReferredLogin)
+		if err != nil {
+			return nil, err
+		}
+		if referrerID.Status != pgtype.Present {
+			return (*ReferralBonus)(nil), nil
+		}
+		ref.ReferrerID = int(referrerID.Int)
+
+		// Обе строки блокируются в порядке id, чтобы встречные операции над этой парой не взаимоблокировались.
+		query = `SELECT id, disabled 
+		FROM GophermartUsers 
+		WHERE id IN ($1, $2) 
+		ORDER BY id 
+		FOR UPDATE`
+		res, err := tx.Query(query, referredID, ref.ReferrerID)
+		if err != nil {
+			return nil, err
+		}
+		referrerDisabled := false
+		for res.Next() {
+			var id int
+			var disabled bool
+			err := res.Scan(&id, &disabled)
+			if err != nil {
+				res.Close()
+				return nil, err
+			}
+			if id == ref.ReferrerID {
+				referrerDisabled = disabled
+			}
+		}
+		res.Close()
+		if res.Err() != nil {
+			return nil, res.Err()
+		}
+
+		query = `SELECT COUNT(*) 
+		FROM GophermartReferralBonuses 
+		WHERE referrer_id=$1 AND referrer_bonus>0`
+		var credited int
+		err = tx.QueryRow(query, ref.ReferrerID).Scan(&credited)
+		if err != nil {
+			return nil, err
+		}
+		if !referrerDisabled && credited < limit {
+			ref.ReferrerBonus = bonus
+		}
+
+		query = `INSERT INTO GophermartReferralBonuses 
+		(referrer_id, referred_id, number, referrer_bonus, referred_bonus, credited_at) 
+		VALUES($1, $2, $3, $4, $5, $6) 
+		ON CONFLICT (referred_id) DO NOTHING`
+		res2, err := tx.Exec(query, ref.ReferrerID, referredID, orderNum, ref.ReferrerBonus, ref.ReferredBonus, now)
+		if err != nil {
+			return nil, err
+		}
+		if res2.RowsAffected() == 0 {
+			return (*ReferralBonus)(nil), nil
+		}
+
+		credits := []struct {
+			loginID int
+			number  string
+			amount  float64
+		}{{referredID, orderNum, ref.ReferredBonus}, {ref.ReferrerID, "", ref.ReferrerBonus}}
+		for _, c := range credits {
+			if c.amount == 0 {
+				continue
+			}
+			query = `UPDATE GophermartUsers 
+			SET current_balance=current_balance+$1, data_version=data_version+1, data_changed_at=$3
+			WHERE id=$2`
+			_, err = tx.Exec(query, c.amount, c.loginID, now)
+			if err != nil {
+				return nil, err
+			}
+			err = insertPointLot(tx, c.loginID, PointLotReferral, c.number, c.amount, now, expiresAt)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &ref, nil
+	}
+}
+
+const (
+	TransferPending   = "pending"
+	TransferCompleted = "completed"
+	TransferExpired   = "expired"
+)
+
+// Результаты проведения перевода.
+const (
+	TransferOK                = "ok"
+	TransferNotFound          = "not_found"
+	TransferNotPending        = "not_pending"
+	TransferRecipientDisabled = "recipient_disabled"
+	TransferInsufficientFunds = "insufficient_funds"
+	TransferLimitExceeded     = "limit_exceeded"
+)
+
+type Transfer struct {
+	ID          int     `json:"id"`
+	FromID      int     `json:"-"`
+	ToID        int     `json:"-"`
+	Direction   string  `json:"direction"`
+	Login       string  `json:"login"`
+	Sum         float64 `json:"sum"`
+	Comment     string  `json:"comment,omitempty"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+	ExpiresAt   string  `json:"expires_at,omitempty"`
+	CompletedAt string  `json:"completed_at,omitempty"`
+}
+
+// TransferLimits ограничивают исходящие переводы пользователя за календарный день по UTC.
+type TransferLimits struct {
+	DailySum   float64
+	DailyCount int
+}
+
+// checkTransfer блокирует строки обоих пользователей через lockBalance в порядке id, чтобы встречные переводы
+// не взаимоблокировались, и проверяет получателя, баланс и дневные лимиты отправителя. Неподтверждённые переводы,
+// кроме самого t, резервируют и лимиты, и баллы: иначе их можно накопить сколько угодно и подтвердить разом.
+// Возвращает текущий баланс отправителя.
+func checkTransfer(tx *pgx.Tx, t *Transfer, limits *TransferLimits, now time.Time) (string, float32, error) {
+	ids := []int{t.FromID, t.ToID}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	var current, held float32
+	for _, id := range ids {
+		c, h, err := lockBalance(tx, id)
+		if err != nil {
+			return "", 0, err
+		}
+		if id == t.FromID {
+			current, held = c, h
+		}
+	}
+
+	query := `SELECT disabled 
+	FROM GophermartUsers 
+	WHERE id=$1`
+	var disabled bool
+	err := tx.QueryRow(query, t.ToID).Scan(&disabled)
+	if err != nil {
+		return "", 0, err
+	}
+	if disabled {
+		return TransferRecipientDisabled, 0, nil
+	}
+
+	query = `SELECT COUNT(*), COALESCE(SUM(sum), 0), COALESCE(SUM(sum) FILTER (WHERE status='pending'), 0) 
+	FROM GophermartTransfers 
+	WHERE from_id=$1 AND id<>$4 
+		AND ((status='completed' AND completed_at>=$2) OR (status='pending' AND expires_at>$3))`
+	var count int
+	var sent, pending float64
+	err = tx.QueryRow(query, t.FromID, now.Truncate(24*time.Hour), now, t.ID).Scan(&count, &sent, &pending)
+	if err != nil {
+		return "", 0, err
+	}
+	if float64(current-held)-pending < t.Sum {
+		return TransferInsufficientFunds, 0, nil
+	}
+	if count >= limits.DailyCount || roundPoints(sent+t.Sum) > limits.DailySum {
+		return TransferLimitExceeded, 0, nil
+	}
+	return TransferOK, current, nil
+}
+
+// executeTransfer переносит баллы t.Sum от t.FromID к t.ToID после проверок checkTransfer. Партии получателя
+// сохраняют ближайший срок сгорания списанных партий отправителя: перевод не продлевает жизнь баллов.
+func executeTransfer(tx *pgx.Tx, t *Transfer, limits *TransferLimits, now time.Time) (string, error) {
+	outcome, current, err := checkTransfer(tx, t, limits, now)
+	if err != nil || outcome != TransferOK {
+		return outcome, err
+	}
+
+	query := `UPDATE GophermartUsers 
+	SET current_balance=current_balance+$1, data_version=data_version+1, data_changed_at=$3
+	WHERE id=$2`
+	_, err = tx.Exec(query, -t.Sum, t.FromID, now)
+	if err != nil {
+		return "", err
+	}
+	expiresAt, err := consumePointLots(tx, t.FromID, float64(current), t.Sum)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(query, t.Sum, t.ToID, now)
+	if err != nil {
+		return "", err
+	}
+	err = insertPointLot(tx, t.ToID, PointLotTransfer, "", t.Sum, now, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	t.Status = TransferCompleted
+	t.CompletedAt = now.Format(time.RFC3339)
+	return TransferOK, nil
+}
+
+type TransferResult struct {
+	Outcome  string
+	Transfer *Transfer
+}
+
+// CreateTransfer сразу проводит перевод t, а с непустым expiresAt проверяет его и сохраняет до подтверждения отправителем.
+func (db *DBConnection) CreateTransfer(t Transfer, limits *TransferLimits, now time.Time, expiresAt *time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		t.Status = TransferPending
+		t.CreatedAt = now.Format(time.RFC3339)
+		var completedAt *time.Time
+		if expiresAt != nil {
+			t.ExpiresAt = expiresAt.Format(time.RFC3339)
+			outcome, _, err := checkTransfer(tx, &t, limits, now)
+			if err != nil || outcome != TransferOK {
+				return &TransferResult{Outcome: outcome}, err
+			}
+		} else {
+			outcome, err := executeTransfer(tx, &t, limits, now)
+			if err != nil || outcome != TransferOK {
+				return &TransferResult{Outcome: outcome}, err
+			}
+			completedAt = &now
+		}
+
+		query := `INSERT INTO GophermartTransfers 
+		(from_id, to_id, sum, comment, status, created_at, expires_at, completed_at) 
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) 
+		RETURNING id`
+		err = tx.QueryRow(query, t.FromID, t.ToID, t.Sum, t.Comment, t.Status, now, expiresAt, completedAt).Scan(&t.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &TransferResult{Outcome: TransferOK, Transfer: &t}, nil
+	}
+}
+
+// ConfirmTransfer проводит ожидающий подтверждения перевод transferID отправителя fromID, если его срок не истёк.
+func (db *DBConnection) ConfirmTransfer(fromID, transferID int, limits *TransferLimits, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `SELECT t.to_id, u.login, t.sum, t.comment, t.status, t.created_at, t.expires_at 
+		FROM GophermartTransfers t JOIN GophermartUsers u ON u.id=t.to_id 
+		WHERE t.id=$1 AND t.from_id=$2 
+		FOR UPDATE OF t`
+		t := Transfer{ID: transferID, FromID: fromID, Direction: TransferOutgoing}
+		var createdAt, expiresAt pgtype.Timestamptz
+		err = tx.QueryRow(query, transferID, fromID).Scan(&t.ToID, &t.Login, &t.Sum, &t.Comment, &t.Status,
+			&createdAt, &expiresAt)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return &TransferResult{Outcome: TransferNotFound}, nil
+			}
+			return nil, err
+		}
+		if t.Status != TransferPending || !expiresAt.Time.After(now) {
+			return &TransferResult{Outcome: TransferNotPending}, nil
+		}
+		t.CreatedAt = createdAt.Time.Format(time.RFC3339)
+
+		outcome, err := executeTransfer(tx, &t, limits, now)
+		if err != nil || outcome != TransferOK {
+			return &TransferResult{Outcome: outcome}, err
+		}
+
+		query = `UPDATE GophermartTransfers 
+		SET status=$1, completed_at=$2
+		WHERE id=$3`
+		_, err = tx.Exec(query, t.Status, now, transferID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &TransferResult{Outcome: TransferOK, Transfer: &t}, nil
+	}
+}
+
+const (
+	TransferOutgoing = "outgoing"
+	TransferIncoming = "incoming"
+)
+
+// GetTransfers возвращает переводы пользователя в обе стороны, новые первыми.
+// Неподтверждённые переводы видит только отправитель; просроченные показываются со статусом expired.
+func (db *DBConnection) GetTransfers(loginID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		var transfers []Transfer
+		query := `SELECT t.id, CASE WHEN t.from_id=$1 THEN 'outgoing' ELSE 'incoming' END, u.login, 
+			t.sum, t.comment, t.status, t.created_at, t.expires_at, t.completed_at 
+		FROM GophermartTransfers t 
+			JOIN GophermartUsers u ON u.id=CASE WHEN t.from_id=$1 THEN t.to_id ELSE t.from_id END 
+		WHERE t.from_id=$1 OR (t.to_id=$1 AND t.status='completed') 
+		ORDER BY t.created_at DESC, t.id DESC`
+		res, err := db.conn.Query(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var t Transfer
+			var createdAt, expiresAt, completedAt pgtype.Timestamptz
+			err := res.Scan(&t.ID, &t.Direction, &t.Login, &t.Sum, &t.Comment, &t.Status,
+				&createdAt, &expiresAt, &completedAt)
+			if err != nil {
+				return nil, err
+			}
+			t.CreatedAt = createdAt.Time.Format(time.RFC3339)
+			if t.Status == TransferPending {
+				t.ExpiresAt = expiresAt.Time.Format(time.RFC3339)
+				if !expiresAt.Time.After(now) {
+					t.Status = TransferExpired
+				}
+			}
+			if completedAt.Status == pgtype.Present {
+				t.CompletedAt = completedAt.Time.Format(time.RFC3339)
+			}
+			transfers = append(transfers, t)
+		}
+		return transfers, res.Err()
+	}
+}
+
+// Результаты отмены списания.
+const (
+	ReversalOK              = "ok"
+	ReversalNotFound        = "not_found"
+	ReversalAlreadyReversed = "already_reversed"
+	ReversalTooLarge        = "too_large"
+)
+
+type Reversal struct {
+	Order     string  `json:"order"`
+	Withdrawn float64 `json:"withdrawn"`
+	Sum       float64 `json:"sum"`
+	// Remaining — сколько списания ещё можно вернуть после этой отмены.
+	Remaining   float64 `json:"remaining"`
+	Reason      string  `json:"reason,omitempty"`
+	ProcessedAt string  `json:"processed_at"`
+}
+
+type ReversalResult struct {
+	Outcome  string
+	LoginID  int
+	Reversal *Reversal
+}
+
+// ReverseWithdrawal возвращает пользователю sum баллов списания по заказу orderNum (nil — весь остаток)
+// и уменьшает balance_withdrawn. Списание можно отменять частями, пока их сумма не превысит списанное.
+// Отмену выполняет либо администратор adminID, либо сервис с ключом apiKeyID; сервису доступны
+// только списания пользователей, чьи заказы он сам регистрировал, остальные для него не существуют.
+func (db *DBConnection) ReverseWithdrawal(orderNum string, sum *float64, reason string, adminID, apiKeyID *int,
+	now time.Time, expiresAt *time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		query := `SELECT id, login_id, withdrawn 
+		FROM GophermartOrders o 
+		WHERE number=$1 AND withdrawn>0 
+			AND ($2::INTEGER IS NULL OR EXISTS (
+				SELECT 1 FROM GophermartOrders k WHERE k.login_id=o.login_id AND k.api_key_id=$2)) 
+		FOR UPDATE`
+		var orderID int
+		result := ReversalResult{Reversal: &Reversal{Order: orderNum, Reason: reason}}
+		err = tx.QueryRow(query, orderNum, apiKeyID).Scan(&orderID, &result.LoginID, &result.Reversal.Withdrawn)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return &ReversalResult{Outcome: ReversalNotFound}, nil
+			}
+			return nil, err
+		}
+
+		// Строка заказа заблокирована, так что параллельная отмена того же списания дождётся этой.
+		query = `SELECT COALESCE(SUM(sum), 0) 
+		FROM GophermartReversals 
+		WHERE order_id=$1`
+		var reversed float64
+		err = tx.QueryRow(query, orderID).Scan(&reversed)
+		if err != nil {
+			return nil, err
+		}
+		remaining := roundPoints(result.Reversal.Withdrawn - reversed)
+		if remaining <= 0 {
+			return &ReversalResult{Outcome: ReversalAlreadyReversed}, nil
+		}
+		result.Reversal.Sum = remaining
+		if sum != nil {
+			if roundPoints(*sum) > remaining {
+				return &ReversalResult{Outcome: ReversalTooLarge}, nil
+			}
+			result.Reversal.Sum = *sum
+		}
+		result.Reversal.Remaining = roundPoints(remaining - result.Reversal.Sum)
+
+		_, _, err = lockBalance(tx, result.LoginID)
+		if err != nil {
+			return nil, err
+		}
+
+		query = `INSERT INTO GophermartReversals 
+		(order_id, login_id, sum, reason, admin_id, api_key_id, processed_at) 
+		VALUES($1, $2, $3, $4, $5, $6, $7)`
+		_, err = tx.Exec(query, orderID, result.LoginID, result.Reversal.Sum, reason, adminID, apiKeyID, now)
+		if err != nil {
+			return nil, err
+		}
+
+		query = `UPDATE GophermartUsers 
+		SET current_balance=current_balance+$1, balance_withdrawn=balance_withdrawn-$1, 
+			data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		_, err = tx.Exec(query, result.Reversal.Sum, result.LoginID, now)
+		if err != nil {
+			return nil, err
+		}
+
+		err = insertPointLot(tx, result.LoginID, PointLotReversal, orderNum, result.Reversal.Sum, now, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		result.Outcome = ReversalOK
+		result.Reversal.ProcessedAt = now.Format(time.RFC3339)
+		return &result, nil
+	}
+}
+
+const (
+	HoldHeld     = "held"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+// Результаты операций с холдами.
+const (
+	HoldOK                = "ok"
+	HoldNotFound          = "not_found"
+	HoldNotActive         = "not_active"
+	HoldOrderUsed         = "order_used"
+	HoldInsufficientFunds = "insufficient_funds"
+)
+
+type Hold struct {
+	ID         int     `json:"id"`
+	Order      string  `json:"order"`
+	Sum        float64 `json:"sum"`
+	Status     string  `json:"status"`
+	CreatedAt  string  `json:"created_at"`
+	ExpiresAt  string  `json:"expires_at"`
+	ResolvedAt string  `json:"resolved_at,omitempty"`
+	// expiresAt — срок холда для сравнений; строковые поля только для ответа клиенту.
+	expiresAt time.Time
+}
+
+type HoldResult struct {
+	Outcome string
+	Hold    *Hold
+}
+
+const holdsQuery = `SELECT id, number, sum, status, created_at, expires_at, resolved_at 
+	FROM GophermartHolds`
+
+func scanHold(row interface{ Scan(...interface{}) error }) (*Hold, error) {
+	var h Hold
+	var createdAt, expiresAt, resolvedAt pgtype.Timestamptz
+	err := row.Scan(&h.ID, &h.Order, &h.Sum, &h.Status, &createdAt, &expiresAt, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	h.CreatedAt = createdAt.Time.Format(time.RFC3339)
+	h.ExpiresAt = expiresAt.Time.Format(time.RFC3339)
+	h.expiresAt = expiresAt.Time
+	if resolvedAt.Status == pgtype.Present {
+		h.ResolvedAt = resolvedAt.Time.Format(time.RFC3339)
+	}
+	return &h, nil
+}
+
+// CreateHold удерживает sum баллов под заказ orderNum до expiresAt: доступный баланс уменьшается, общий — нет.
+func (db *DBConnection) CreateHold(loginID int, orderNum string, sum float32, now, expiresAt time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		current, held, err := lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+		if current-held < sum {
+			return &HoldResult{Outcome: HoldInsufficientFunds}, nil
+		}
+
+		query := `SELECT EXISTS (SELECT 1 FROM GophermartOrders WHERE number=$1) 
+			OR EXISTS (SELECT 1 FROM GophermartHolds WHERE number=$1 AND status='held')`
+		var used bool
+		err = tx.QueryRow(query, orderNum).Scan(&used)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			return &HoldResult{Outcome: HoldOrderUsed}, nil
+		}
+
+		query = `INSERT INTO GophermartHolds 
+		(login_id, number, sum, status, created_at, expires_at) 
+		VALUES($1, $2, $3, 'held', $4, $5) 
+		RETURNING id`
+		hold := Hold{Order: orderNum, Sum: float64(sum), Status: HoldHeld,
+			CreatedAt: now.Format(time.RFC3339), ExpiresAt: expiresAt.Format(time.RFC3339), expiresAt: expiresAt}
+		err = tx.QueryRow(query, loginID, orderNum, sum, now, expiresAt).Scan(&hold.ID)
+		if err != nil {
+			if pgerr, ok := err.(pgx.PgError); ok && pgerr.Code == pgerrcode.UniqueViolation {
+				return &HoldResult{Outcome: HoldOrderUsed}, nil
+			}
+			return nil, err
+		}
+
+		query = `UPDATE GophermartUsers 
+		SET held=held+$1, data_version=data_version+1, data_changed_at=$3
+		WHERE id=$2`
+		_, err = tx.Exec(query, sum, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &HoldResult{Outcome: HoldOK, Hold: &hold}, nil
+	}
+}
+
+// lockHold блокирует действующий холд пользователя. Строка пользователя должна быть уже заблокирована lockBalance:
+// все операции с холдами берут блокировки в этом порядке.
+func lockHold(tx *pgx.Tx, loginID, holdID int, now time.Time) (*Hold, string, error) {
+	query := holdsQuery + ` 
+	WHERE id=$1 AND login_id=$2 
+	FOR UPDATE`
+	hold, err := scanHold(tx.QueryRow(query, holdID, loginID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, HoldNotFound, nil
+		}
+		return nil, "", err
+	}
+	if hold.Status != HoldHeld || !hold.expiresAt.After(now) {
+		return nil, HoldNotActive, nil
+	}
+	return hold, HoldOK, nil
+}
+
+// resolveHold снимает удержание: переводит холд в status и уменьшает held пользователя.
+func resolveHold(tx *pgx.Tx, loginID int, hold *Hold, status string, now time.Time) error {
+	query := `UPDATE GophermartHolds 
+	SET status=$1, resolved_at=$2
+	WHERE id=$3`
+	_, err := tx.Exec(query, status, now, hold.ID)
+	if err != nil {
+		return err
+	}
+	query = `UPDATE GophermartUsers 
+	SET held=GREATEST(held-$1, 0), data_version=data_version+1, data_changed_at=$3
+	WHERE id=$2`
+	_, err = tx.Exec(query, hold.Sum, loginID, now)
+	if err != nil {
+		return err
+	}
+	hold.Status = status
+	hold.ResolvedAt = now.Format(time.RFC3339)
+	return nil
+}
+
+// CaptureHold превращает холд в списание по его заказу. Если баллы успели сгореть и общего баланса
+// не хватает, холд снимается без списания.
+func (db *DBConnection) CaptureHold(loginID, holdID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		current, _, err := lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+		hold, outcome, err := lockHold(tx, loginID, holdID, now)
+		if err != nil || outcome != HoldOK {
+			return &HoldResult{Outcome: outcome}, err
+		}
+
+		if current < float32(hold.Sum) {
+			err = resolveHold(tx, loginID, hold, HoldReleased, now)
+			if err != nil {
+				return nil, err
+			}
+			err = tx.Commit()
+			if err != nil {
+				return nil, err
+			}
+			return &HoldResult{Outcome: HoldInsufficientFunds, Hold: hold}, nil
+		}
+
+		query := `INSERT INTO GophermartOrders 
+		(login_id, number, status, accrual, withdrawn, uploaded_at) 
+		VALUES($1, $2, 'NEW', 0, $3, $4)`
+		_, err = tx.Exec(query, loginID, hold.Order, hold.Sum, now)
+		if err != nil {
+			if pgerr, ok := err.(pgx.PgError); ok && pgerr.Code == pgerrcode.UniqueViolation {
+				return &HoldResult{Outcome: HoldOrderUsed}, nil
+			}
+			return nil, err
+		}
+
+		err = resolveHold(tx, loginID, hold, HoldCaptured, now)
+		if err != nil {
+			return nil, err
+		}
+		query = `UPDATE GophermartUsers 
+		SET current_balance=current_balance-$1, balance_withdrawn=balance_withdrawn+$1
+		WHERE id=$2`
+		_, err = tx.Exec(query, hold.Sum, loginID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = consumePointLots(tx, loginID, float64(current), hold.Sum)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &HoldResult{Outcome: HoldOK, Hold: hold}, nil
+	}
+}
+
+// ReleaseHold снимает холд без списания.
+func (db *DBConnection) ReleaseHold(loginID, holdID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		_, _, err = lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+		hold, outcome, err := lockHold(tx, loginID, holdID, now)
+		if err != nil || outcome != HoldOK {
+			return &HoldResult{Outcome: outcome}, err
+		}
+		err = resolveHold(tx, loginID, hold, HoldReleased, now)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &HoldResult{Outcome: HoldOK, Hold: hold}, nil
+	}
+}
+
+// GetHolds возвращает холды пользователя, новые первыми. Просроченный, но ещё не снятый холд показывается как expired.
+func (db *DBConnection) GetHolds(loginID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		var holds []Hold
+		query := holdsQuery + ` 
+		WHERE login_id=$1 
+		ORDER BY created_at DESC, id DESC`
+		res, err := db.conn.Query(query, loginID)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			hold, err := scanHold(res)
+			if err != nil {
+				return nil, err
+			}
+			if hold.Status == HoldHeld && !hold.expiresAt.After(now) {
+				hold.Status = HoldExpired
+			}
+			holds = append(holds, *hold)
+		}
+		return holds, res.Err()
+	}
+}
+
+// GetUsersWithExpiredHolds возвращает пользователей, у которых есть холды с истёкшим к now сроком.
+func (db *DBConnection) GetUsersWithExpiredHolds(now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		var loginIDs []int
+		query := `SELECT DISTINCT login_id 
+		FROM GophermartHolds 
+		WHERE status='held' AND expires_at<=$1`
+		res, err := db.conn.Query(query, now)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var loginID int
+			err := res.Scan(&loginID)
+			if err != nil {
+				return nil, err
+			}
+			loginIDs = append(loginIDs, loginID)
+		}
+		return loginIDs, res.Err()
+	}
+}
+
+// ReleaseExpiredHolds снимает истёкшие холды пользователя и возвращает их.
+func (db *DBConnection) ReleaseExpiredHolds(loginID int, now time.Time) RetryFunc {
+	return func() (interface{}, error) {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		_, _, err = lockBalance(tx, loginID)
+		if err != nil {
+			return nil, err
+		}
+
+		query := holdsQuery + ` 
+		WHERE login_id=$1 AND status='held' AND expires_at<=$2 
+		FOR UPDATE`
+		res, err := tx.Query(query, loginID, now)
+		if err != nil {
+			return nil, err
+		}
+		var holds []Hold
+		for res.Next() {
+			hold, err := scanHold(res)
+			if err != nil {
+				res.Close()
+				return nil, err
+			}
+			holds = append(holds, *hold)
+		}
+		res.Close()
+		if res.Err() != nil {
+			return nil, res.Err()
+		}
+
+		for i := range holds {
+			err = resolveHold(tx, loginID, &holds[i], HoldExpired, now)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return holds, nil
 	}
 }
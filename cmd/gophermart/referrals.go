@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultReferralLimit = 20
+	// referralCodeAttempts — сколько раз выпускать новый код, если случайный код уже занят.
+	referralCodeAttempts = 3
+)
+
+type ReferralEvent struct {
+	Order   string  `json:"order,omitempty"`
+	Invitee string  `json:"invitee,omitempty"`
+	Sum     float64 `json:"sum"`
+}
+
+type ReferralsInfo struct {
+	Code string `json:"code"`
+	// Bonus — сколько сейчас получают пригласивший и приглашённый за первый обработанный заказ.
+	Bonus     float64    `json:"bonus"`
+	Limit     int        `json:"limit"`
+	Earned    float64    `json:"earned"`
+	Referrals []Referral `json:"referrals"`
+}
+
+// creditReferral начисляет реферальный бонус, если заказ orderNum — первый обработанный заказ приглашённого пользователя.
+func creditReferral(handlerVars *HandlerVars, loginID int, orderNum string) {
+	if handlerVars.ReferralBonus <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.CreditReferral(loginID, orderNum,
+		handlerVars.ReferralBonus, handlerVars.ReferralLimit, now, handlerVars.pointsExpiresAt(now)))
+	if err != nil {
+		sugar.Errorln("Could not credit referral bonus for order", orderNum, err.Error())
+		return
+	}
+	ref := obj.(*ReferralBonus)
+	if ref == nil {
+		return
+	}
+	sugar.Infoln("referral bonus for order", orderNum, "credited to user", loginID, "and", ref.ReferrerBonus, "to referrer", ref.ReferrerID)
+	publishEvent(handlerVars, loginID, EventReferralCredited, &ReferralEvent{Order: orderNum, Sum: ref.ReferredBonus})
+	if ref.ReferrerBonus > 0 {
+		publishEvent(handlerVars, ref.ReferrerID, EventReferralCredited,
+			&ReferralEvent{Invitee: ref.ReferredLogin, Sum: ref.ReferrerBonus})
+	}
+}
+
+// referralCode возвращает код пользователя, выпуская его при первом обращении.
+func referralCode(handlerVars *HandlerVars, loginID int) (string, error) {
+	for i := 0; i < referralCodeAttempts; i++ {
+		code, err := GenerateReferralCode()
+		if err != nil {
+			return "", err
+		}
+		obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetReferralCode(loginID, code))
+		if err != nil {
+			return "", err
+		}
+		if code = obj.(string); code != "" {
+			return code, nil
+		}
+	}
+	return "", errors.New("could not issue a unique referral code")
+}
+
+func referralsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	code, err := referralCode(handlerVars, user.ID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetReferrals(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	info := ReferralsInfo{
+		Code:      code,
+		Bonus:     handlerVars.ReferralBonus,
+		Limit:     handlerVars.ReferralLimit,
+		Referrals: obj.([]Referral),
+	}
+	if info.Referrals == nil {
+		info.Referrals = []Referral{}
+	}
+	for _, ref := range info.Referrals {
+		info.Earned += ref.Bonus
+	}
+	info.Earned = roundPoints(info.Earned)
+	writeJSON(w, &info)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const maxReversalReasonLen = 200
+
+// ReversalRequest — отмена списания по заказу. Без Sum пользователю возвращается всё, что ещё не возвращено.
+type ReversalRequest struct {
+	Sum    *float64 `json:"sum"`
+	Reason string   `json:"reason"`
+}
+
+// readReversalRequest разбирает тело запроса отмены и пишет ошибку в ответ, если это не удалось.
+func readReversalRequest(w http.ResponseWriter, r *http.Request) (*ReversalRequest, bool) {
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return nil, false
+	}
+
+	var req ReversalRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return nil, false
+	}
+	if req.Sum != nil && *req.Sum <= 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "sum must be positive."))
+		return nil, false
+	}
+	if len(req.Reason) > maxReversalReasonLen {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "reason is too long."))
+		return nil, false
+	}
+	return &req, true
+}
+
+// reverseWithdrawal отменяет списание по заказу orderNum от имени администратора adminID или сервиса apiKeyID.
+func reverseWithdrawal(handlerVars *HandlerVars, orderNum string, req *ReversalRequest, adminID, apiKeyID *int) (*Reversal, error) {
+	now := time.Now().UTC()
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.ReverseWithdrawal(orderNum, req.Sum, req.Reason,
+		adminID, apiKeyID, now, handlerVars.pointsExpiresAt(now)))
+	if err != nil {
+		return nil, err
+	}
+	result := obj.(*ReversalResult)
+	switch result.Outcome {
+	case ReversalNotFound:
+		return nil, NewAPIError(http.StatusNotFound, CodeOrderNotFound, "Withdrawal not found.")
+	case ReversalAlreadyReversed:
+		return nil, NewAPIError(http.StatusConflict, CodeAlreadyReversed, "Withdrawal is already fully reversed.")
+	case ReversalTooLarge:
+		return nil, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "sum must not exceed the part of the withdrawal not reversed yet.")
+	}
+	publishEvent(handlerVars, result.LoginID, EventWithdrawalReversed,
+		&PointsEvent{Order: orderNum, Sum: float32(result.Reversal.Sum)})
+	return result.Reversal, nil
+}
+
+func adminReverseWithdrawalPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	req, ok := readReversalRequest(w, r)
+	if !ok {
+		return
+	}
+	reversal, err := reverseWithdrawal(handlerVars, ps.ByName("order"), req, &user.ID, nil)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	sugar.Infoln("admin", user.ID, "reversed", reversal.Sum, "of withdrawal", reversal.Order)
+	writeJSON(w, reversal)
+}
+
+func serviceReverseWithdrawalPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	key, ok := ServiceKeyFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	req, ok := readReversalRequest(w, r)
+	if !ok {
+		return
+	}
+	reversal, err := reverseWithdrawal(handlerVars, ps.ByName("order"), req, nil, &key.ID)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	sugar.Infoln("api key", key.ID, "reversed", reversal.Sum, "of withdrawal", reversal.Order)
+	writeJSON(w, reversal)
+}
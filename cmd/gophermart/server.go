@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,35 +20,134 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-// POST /api/user/register — регистрация пользователя;
+// GET /api/openapi.json — описание API в формате OpenAPI 3.0, по нему же проверяются входящие запросы;
+// POST /api/user/register — регистрация пользователя, необязательный referral_code связывает его с пригласившим;
 // POST /api/user/login — аутентификация пользователя;
+// POST /api/user/login/2fa — подтверждение входа вторым фактором;
 // POST /api/user/orders — загрузка пользователем номера заказа для расчёта;
+// POST /api/user/orders/batch — загрузка пачки номеров заказов (JSON-массив или строки text/plain), ответ 207 с итогом по каждому номеру;
 // GET /api/user/orders — получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях;
+//   необязательные параметры: limit, cursor, status, from, to (RFC3339), sort=asc|desc; ссылка на следующую страницу — в заголовке Link;
+// GET /api/user/orders/:number — получение одного заказа пользователя, refresh=true запрашивает начисление повторно;
 // GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
+//   ближайшие сроки сгорания баллов — в поле expiring_soon, удержанные под холды баллы — в поле held, доступные к списанию — в available;
+//   с параметром at (RFC3339) — баланса на этот момент, восстановленного по истории операций;
+// GET /api/user/balance/history — остаток на конец каждого дня за период from..to (YYYY-MM-DD) в часовом поясе tz;
 // POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
-// GET /api/user/withdrawals — получение информации о выводе средств с накопительного счёта пользователем.
+// POST /api/user/balance/transfer — перевод баллов другому пользователю в пределах дневных лимитов;
+//   перевод больше порога ждёт подтверждения: POST /api/user/balance/transfer/:id/confirm, с кодом второго фактора, если он включён;
+// GET /api/user/transfers — входящие и исходящие переводы;
+// POST /api/user/balance/holds — удержание баллов под заказ: доступный баланс уменьшается, общий — нет;
+//   POST /api/user/balance/holds/:id/capture списывает удержанные баллы, POST /api/user/balance/holds/:id/release снимает холд,
+//   не подтверждённый до expires_in холд снимается автоматически;
+// GET /api/user/balance/holds — холды пользователя;
+// GET /api/user/withdrawals — получение информации о выводе средств с накопительного счёта пользователем;
+//   необязательные параметры: limit, cursor, from, to (RFC3339), min_sum, max_sum, sort=asc|desc;
+//   итоги по диапазону — в заголовках X-Total-Count и X-Total-Sum или в обёртке при Accept: application/json; profile=page;
+//   GET /api/user/balance, /orders и /withdrawals отдают ETag и Last-Modified и отвечают 304 на If-None-Match и If-Modified-Since;
+// GET /api/user/adjustments — получение истории ручных корректировок баланса пользователя;
+//   в общей истории операций корректировки показываются в выписке /api/user/statement строками type=adjustment;
+// GET /api/user/statement — выписка начислений, списаний и корректировок с текущим остатком после каждой операции;
+//   необязательные параметры: from, to (RFC3339), format=json|csv;
+// GET /api/user/tier — уровень лояльности по начислениям за скользящее окно и прогресс до следующего уровня;
+// GET /api/user/tier/history — история смены уровней;
+// GET /api/user/referrals — реферальный код пользователя, приглашённые им и начисленные за них бонусы;
+// GET /api/user/events — SSE-поток событий пользователя с поддержкой Last-Event-ID;
+// POST /api/user/2fa/enroll — выпуск секрета TOTP;
+// POST /api/user/2fa/confirm — включение второго фактора первым кодом и выдача кодов восстановления, текущий токен отзывается;
+// POST /api/user/2fa/disable — отключение второго фактора.
+//
+// Любая ошибка возвращается JSON-объектом ErrorResponse с кодом, сообщением и идентификатором запроса из X-Request-ID.
 
 func runServer(config *Config) {
+	tiers, err := ParseTierPolicy(config.LoyaltyTiers, config.TierWindowDays)
+	if err != nil {
+		panic("Invalid loyalty tiers. " + err.Error())
+	}
 	obj, err := Retrypg(pgerrcode.ConnectionException, NewDBConnection(config.DatabaseURI))
 	if err != nil {
 		panic(err)
 	}
-	handlerVars := &HandlerVars{AccrualSystemAddress: &config.AccrualSystemAddress}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handlerVars := &HandlerVars{
+		ctx:                  ctx,
+		AccrualSystemAddress: &config.AccrualSystemAddress,
+		PointsExpiryMonths:   config.PointsExpiryMonths,
+		Tiers:                tiers,
+		ReferralBonus:        config.ReferralBonus,
+		ReferralLimit:        config.ReferralLimit,
+		TransferConfirmOver:  config.TransferConfirmOver,
+		TransferLimits:       TransferLimits{DailySum: config.TransferDailyLimit, DailyCount: config.TransferDailyCount},
+		events:               NewEventBroker(),
+	}
 	handlerVars.db = obj.(*DBConnection)
 	dbCreateTokenFunc := handlerVars.db.InitTables()
 	_, err = Retrypg(pgerrcode.ConnectionException, dbCreateTokenFunc)
 	if err != nil {
 		panic("Could not init tables. " + err.Error())
 	}
+	if config.AdminLogin != "" {
+		_, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.SetUserRole(config.AdminLogin, RoleAdmin))
+		if err != nil {
+			sugar.Errorln("Could not grant admin role to " + config.AdminLogin + ". " + err.Error())
+		}
+	}
 
 	router := httprouter.New()
-	router.POST("/api/user/register", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(registerPage, handlerVars))))
-	router.POST("/api/user/login", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(loginPage, handlerVars))))
-	router.POST("/api/user/orders", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(postOrdersPage, handlerVars))))
-	router.GET("/api/user/orders", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(getOrdersPage, handlerVars))))
-	router.GET("/api/user/balance", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(balancePage, handlerVars))))
-	router.POST("/api/user/balance/withdraw", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(balanceWithdrawPage, handlerVars))))
-	router.GET("/api/user/withdrawals", LoggingMiddleware(GzipMiddleware(ParamsMiddleware(withdrawalsPage, handlerVars))))
+	router.NotFound = errorHandler(NewAPIError(http.StatusNotFound, CodeNotFound, "Not found."))
+	router.MethodNotAllowed = errorHandler(NewAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed."))
+	router.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		writeInternalError(w, fmt.Errorf("panic: %v", v))
+	}
+	router.GET("/api/openapi.json", RequestIDMiddleware(LoggingMiddleware(CompressionMiddleware(openAPIPage))))
+	router.POST("/api/user/register", publicRoute(registerPage, handlerVars))
+	router.POST("/api/user/login", publicRoute(loginPage, handlerVars))
+	router.POST("/api/user/login/2fa", publicRoute(loginSecondFactorPage, handlerVars))
+	router.POST("/api/user/2fa/enroll", authRoute(enrollTOTPPage, handlerVars))
+	router.POST("/api/user/2fa/confirm", authRoute(confirmTOTPPage, handlerVars))
+	router.POST("/api/user/2fa/disable", authRoute(disableTOTPPage, handlerVars))
+	router.POST("/api/user/orders", authRoute(postOrdersPage, handlerVars))
+	router.GET("/api/user/orders", authRoute(getOrdersPage, handlerVars))
+	router.GET("/api/user/orders/:number", authRoute(getOrderPage, handlerVars))
+	router.POST("/api/user/orders/batch", authRoute(postOrdersBatchPage, handlerVars))
+	router.GET("/api/user/balance", authRoute(balancePage, handlerVars))
+	router.GET("/api/user/balance/history", authRoute(balanceHistoryPage, handlerVars))
+	router.POST("/api/user/balance/withdraw", authRoute(balanceWithdrawPage, handlerVars))
+	router.POST("/api/user/balance/transfer", authRoute(transferPage, handlerVars))
+	router.POST("/api/user/balance/transfer/:id/confirm", authRoute(confirmTransferPage, handlerVars))
+	router.POST("/api/user/balance/holds", authRoute(createHoldPage, handlerVars))
+	router.POST("/api/user/balance/holds/:id/capture", authRoute(captureHoldPage, handlerVars))
+	router.POST("/api/user/balance/holds/:id/release", authRoute(releaseHoldPage, handlerVars))
+	router.GET("/api/user/balance/holds", authRoute(holdsPage, handlerVars))
+	router.GET("/api/user/withdrawals", authRoute(withdrawalsPage, handlerVars))
+	router.GET("/api/user/transfers", authRoute(transfersPage, handlerVars))
+	router.GET("/api/user/adjustments", authRoute(adjustmentsPage, handlerVars))
+	router.GET("/api/user/statement", authRoute(statementPage, handlerVars))
+	router.GET("/api/user/tier", authRoute(tierPage, handlerVars))
+	router.GET("/api/user/tier/history", authRoute(tierHistoryPage, handlerVars))
+	router.GET("/api/user/referrals", authRoute(referralsPage, handlerVars))
+	router.GET("/api/user/events", streamRoute(eventsPage, handlerVars))
+	registerAdminRoutes(router, handlerVars)
+	registerCampaignRoutes(router, handlerVars)
+	registerServiceRoutes(router, handlerVars)
+	registerWebhookRoutes(router, handlerVars)
+
+	go runWebhookWorker(ctx, handlerVars)
+	if config.PointsExpiryMonths > 0 {
+		go runPointsExpiryWorker(ctx, handlerVars)
+	}
+	go runTierReviewWorker(ctx, handlerVars)
+	go runHoldReleaseWorker(ctx, handlerVars)
+
+	// gRPC-сервер (api/gophermartpb) запускается, только если задан его адрес.
+	if config.GRPCAddress != "" {
+		grpcServer, err := runGRPCServer(ctx, config.GRPCAddress, handlerVars)
+		if err != nil {
+			panic("Could not start gRPC server. " + err.Error())
+		}
+		defer grpcServer.Stop()
+	}
 
 	server := &http.Server{
 		Addr:    (*config).Address,
@@ -62,6 +163,33 @@ func runServer(config *Config) {
 	fmt.Println("Programm shutdown")
 }
 
+func baseRoute(h httprouter.Handle, handlerVars *HandlerVars) httprouter.Handle {
+	return RequestIDMiddleware(LoggingMiddleware(CompressionMiddleware(ParamsMiddleware(h, handlerVars))))
+}
+
+// Проверка по openapi.json идёт после аутентификации, чтобы без токена клиент получал 401, а не 400.
+
+func publicRoute(h httprouter.Handle, handlerVars *HandlerVars) httprouter.Handle {
+	return baseRoute(ValidationMiddleware(h), handlerVars)
+}
+
+func authRoute(h httprouter.Handle, handlerVars *HandlerVars) httprouter.Handle {
+	return baseRoute(AuthMiddleware(ValidationMiddleware(h)), handlerVars)
+}
+
+// streamRoute не сжимает ответ: компрессор буферизует данные и ломает SSE.
+func streamRoute(h httprouter.Handle, handlerVars *HandlerVars) httprouter.Handle {
+	return RequestIDMiddleware(LoggingMiddleware(ParamsMiddleware(AuthMiddleware(ValidationMiddleware(h)), handlerVars)))
+}
+
+func roleRoute(h httprouter.Handle, handlerVars *HandlerVars, roles ...string) httprouter.Handle {
+	return baseRoute(AuthMiddleware(RoleMiddleware(ValidationMiddleware(h), roles...)), handlerVars)
+}
+
+func serviceRoute(h httprouter.Handle, handlerVars *HandlerVars, scope string) httprouter.Handle {
+	return baseRoute(APIKeyMiddleware(ValidationMiddleware(h), scope), handlerVars)
+}
+
 func waitForShutdown(server *http.Server, handlerVars *HandlerVars) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -75,150 +203,177 @@ type LoginInfo struct {
 	Password string `json:"password"`
 }
 
+type RegistrationInfo struct {
+	LoginInfo
+	ReferralCode string `json:"referral_code"`
+}
+
 func registerPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		http.Error(w, "Request content type is not json!", http.StatusBadRequest)
+		writeError(w, errNotJSON)
 		return
 	}
 
-	var loginInfo LoginInfo
+	var regInfo RegistrationInfo
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not read request body! "+err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
-	err = json.Unmarshal(bodyBytes, &loginInfo)
+	err = json.Unmarshal(bodyBytes, &regInfo)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not unmarshal login info! "+err.Error(), http.StatusBadRequest)
+		writeError(w, errInvalidJSON)
 		return
 	}
 
-	hash, err := HashPassword(loginInfo.Password)
+	token, err := registerUser(&regInfo, handlerVars.db)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
+	w.Header().Set("Authorization", token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// registerUser создаёт пользователя и выдаёт ему токен авторизации.
+func registerUser(regInfo *RegistrationInfo, db *DBConnection) (string, error) {
+	hash, err := HashPassword(regInfo.Password)
+	if err != nil {
+		return "", err
+	}
 	sugar.Infoln(hash)
-	dbWriteNewUserInfoFunc := handlerVars.db.WriteNewUserInfo(loginInfo.Login, hash)
+	referralCode := strings.ToUpper(strings.TrimSpace(regInfo.ReferralCode))
+	dbWriteNewUserInfoFunc := db.WriteNewUserInfo(regInfo.Login, hash, referralCode)
 	_, err = Retrypg(pgerrcode.ConnectionException, dbWriteNewUserInfoFunc)
 	if err != nil {
-		if err.Error() == "Login exists" {
-			sugar.Errorln(err.Error())
-			http.Error(w, err.Error(), http.StatusConflict)
-			return
+		if errors.Is(err, ErrLoginExists) {
+			return "", NewAPIError(http.StatusConflict, CodeLoginTaken, "Login is already taken.")
 		}
-		sugar.Errorln(err.Error())
-		http.Error(w, "Connection to database error", http.StatusInternalServerError)
-		return
+		if errors.Is(err, ErrInvalidReferralCode) {
+			return "", NewAPIError(http.StatusBadRequest, CodeInvalidReferralCode, "Referral code does not exist.")
+		}
+		return "", err
 	}
 
-	dbCreateTokenFunc := handlerVars.db.CreateAuthToken(loginInfo.Login, hash)
+	dbCreateTokenFunc := db.CreateAuthToken(regInfo.Login, hash)
 	obj, err := Retrypg(pgerrcode.ConnectionException, dbCreateTokenFunc)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not create authentication token. "+err.Error(), http.StatusInternalServerError)
+		return "", fmt.Errorf("could not create authentication token: %w", err)
 	}
-	token := obj.(string)
-	w.Header().Set("Authorization", token)
-	w.WriteHeader(http.StatusOK)
+	return obj.(string), nil
 }
 
 func loginPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		http.Error(w, "Request content type is not json!", http.StatusBadRequest)
+		writeError(w, errNotJSON)
 		return
 	}
 
 	var loginInfo LoginInfo
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not read request body! "+err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 	err = json.Unmarshal(bodyBytes, &loginInfo)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not unmarshal login info! "+err.Error(), http.StatusBadRequest)
+		writeError(w, errInvalidJSON)
 		return
 	}
 
-	dbGetUserInfoFunc := handlerVars.db.GetUserInfo(loginInfo.Login)
-	obj, err := Retrypg(pgerrcode.ConnectionException, dbGetUserInfoFunc)
+	userInfo, err := checkCredentials(&loginInfo, handlerVars.db)
 	if err != nil {
-		if err.Error() == "Login does not exist" {
-			sugar.Errorln(err.Error())
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		sugar.Errorln(err.Error())
-		http.Error(w, "Connection to database error", http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
-	userInfo := obj.(*UserInfo)
-	sugar.Infoln(loginInfo.Password)
-	sugar.Infoln(userInfo.Hash)
-	check, err := CheckPassword(loginInfo.Password, userInfo.Hash)
+
+	required, err := secondFactorRequired(userInfo.ID, handlerVars.db)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
-	if !check {
-		http.Error(w, "Wrong password", http.StatusUnauthorized)
+	if required {
+		issueLoginChallenge(w, userInfo.ID, handlerVars.db)
 		return
 	}
 
 	dbCreateTokenFunc := handlerVars.db.CreateAuthToken(loginInfo.Login, userInfo.Hash)
-	obj, err = Retrypg(pgerrcode.ConnectionException, dbCreateTokenFunc)
+	obj, err := Retrypg(pgerrcode.ConnectionException, dbCreateTokenFunc)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not create authentication token. "+err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
+		return
 	}
 	token := obj.(string)
 	w.Header().Set("Authorization", token)
 	w.WriteHeader(http.StatusOK)
 }
 
-func authorization(authData string, db *DBConnection) (int, int, error) {
+var errInvalidCredentials = NewAPIError(http.StatusUnauthorized, CodeInvalidCredentials, "Wrong login or password.")
+
+// checkCredentials находит пользователя по логину и проверяет пароль.
+// Неизвестный логин и неверный пароль неразличимы для клиента, а о блокировке сообщается только после верного пароля.
+func checkCredentials(loginInfo *LoginInfo, db *DBConnection) (*UserInfo, error) {
+	dbGetUserInfoFunc := db.GetUserInfo(loginInfo.Login)
+	obj, err := Retrypg(pgerrcode.ConnectionException, dbGetUserInfoFunc)
+	if err != nil {
+		if errors.Is(err, ErrLoginNotExist) {
+			return nil, errInvalidCredentials
+		}
+		return nil, err
+	}
+	userInfo := obj.(*UserInfo)
+	check, err := CheckPassword(loginInfo.Password, userInfo.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !check {
+		return nil, errInvalidCredentials
+	}
+	if userInfo.Disabled {
+		return nil, errAccountDisabled
+	}
+	return userInfo, nil
+}
+
+func authorization(authData string, db *DBConnection) (*User, error) {
 	if authData == "" {
-		err := errors.New("Unauthorized")
-		return http.StatusUnauthorized, -1, err
+		return nil, errUnauthorized
 	}
 	obj, err := Retrypg(pgerrcode.ConnectionException, db.CheckAuthToken(authData))
 	if err != nil {
-		return http.StatusInternalServerError, -1, err
+		if errors.Is(err, ErrAccountDisabled) {
+			return nil, errAccountDisabled
+		}
+		return nil, err
 	}
-	loginID := obj.(int)
-	if loginID == -1 {
-		err := errors.New("Unauthorized")
-		return http.StatusUnauthorized, -1, err
+	user := obj.(*User)
+	if user == nil {
+		return nil, errUnauthorized
 	}
-	return http.StatusOK, loginID, nil
+	return user, nil
 }
 
-func uploadOrderNumber(loginID int, numb string, db *DBConnection) (int, error) {
-	obj, err := Retrypg(pgerrcode.ConnectionException, db.LoadOrderNumber(loginID, numb))
+func uploadOrderNumber(loginID int, numb string, apiKeyID *int, db *DBConnection) (int, error) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.LoadOrderNumber(loginID, numb, apiKeyID))
 	if err != nil {
-		sugar.Errorln(err.Error())
 		return http.StatusInternalServerError, err
 	}
 	newOrderKey := obj.(int)
 	if newOrderKey == -1 {
-		err := errors.New("order number already loaded")
-		return http.StatusConflict, err
+		return http.StatusConflict, NewAPIError(http.StatusConflict, CodeOrderOwnedByAnotherUser,
+			"Order number was already uploaded by another user.")
 	} else if newOrderKey == -2 {
 		return http.StatusOK, nil
 	}
@@ -232,123 +387,254 @@ type ASAAnswer struct {
 }
 
 func updateOrder(ctx context.Context, loginID int, numb string, handlerVars *HandlerVars) {
-	client := resty.New()
-loop:
 	for {
 		select {
 		case <-ctx.Done():
-			sugar.Infoln("Operation was canselled by user")
+			sugar.Infoln("Accrual polling stopped: server is shutting down")
 			return
 		default:
-			resp, err := client.R().Get(*handlerVars.AccrualSystemAddress + "/api/orders/" + numb)
-			if err != nil {
-				sugar.Errorln(err.Error())
-			}
-			var ans ASAAnswer
-			err = json.Unmarshal(resp.Body(), &ans)
+			ans, err := checkAccrual(loginID, numb, handlerVars)
 			if err != nil {
 				sugar.Errorln(err.Error())
 				time.Sleep(time.Second * 5)
 				continue
 			}
-			sugar.Infoln(ans)
-
-			_, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.UpdateOrder(ans.Accrual, ans.Order, ans.Status))
-			if err != nil {
-				panic(err)
+			if isFinalOrderStatus(ans.Status) {
+				return
 			}
+		}
+	}
+}
 
-			if ans.Accrual > 0 {
-				_, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.AddLoyaltyPoints(loginID, ans.Accrual))
-				if err != nil {
-					panic(err)
-				}
-			}
+func isFinalOrderStatus(status string) bool {
+	return status == "INVALID" || status == "PROCESSED"
+}
 
-			if ans.Status == "INVALID" || ans.Status == "PROCESSED" {
-				break loop
-			}
+// checkAccrual один раз опрашивает систему расчёта начислений и сохраняет ответ.
+// Баллы начисляются только при первом переходе заказа в PROCESSED, поэтому повторные проверки безопасны.
+func checkAccrual(loginID int, numb string, handlerVars *HandlerVars) (*ASAAnswer, error) {
+	resp, err := resty.New().R().Get(*handlerVars.AccrualSystemAddress + "/api/orders/" + numb)
+	if err != nil {
+		return nil, err
+	}
+	var ans ASAAnswer
+	err = json.Unmarshal(resp.Body(), &ans)
+	if err != nil {
+		return nil, err
+	}
+	sugar.Infoln(ans)
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.UpdateOrder(ans.Accrual, numb, ans.Status,
+		handlerVars.pointsExpiresAt(time.Now())))
+	if err != nil {
+		return nil, err
+	}
+	changed := obj.(bool)
+	if changed {
+		publishEvent(handlerVars, loginID, EventOrderStatusChanged,
+			&OrderStatusEvent{Order: numb, Status: ans.Status, Accrual: ans.Accrual})
+	}
+
+	// Баллы уже зачислены вместе со сменой статуса; уровень, акции и реферальный бонус считаются после фиксации.
+	if changed && ans.Status == "PROCESSED" && ans.Accrual > 0 {
+		publishEvent(handlerVars, loginID, EventPointsCredited, &PointsEvent{Order: numb, Sum: ans.Accrual})
+		var tier string
+		status, err := evaluateTier(handlerVars, loginID)
+		if err != nil {
+			sugar.Errorln("Could not evaluate tier of user", loginID, err.Error())
+		} else {
+			tier = status.Tier
 		}
+		applyCampaigns(handlerVars, loginID, numb, ans.Accrual, tier)
+		creditReferral(handlerVars, loginID, numb)
 	}
+	return &ans, nil
 }
 
 func postOrdersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	code, loginID, err := authorization(auth, handlerVars.db)
-	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
 		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "text/plain") {
-		http.Error(w, "Request content type is not plain text!", http.StatusBadRequest)
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeUnsupportedContentType, "Request content type is not plain text."))
 		return
 	}
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not read request body!", http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 	orderNum := string(bodyBytes)
-	c, err := CheckLuhn(orderNum)
+	code, err := submitOrder(user.ID, orderNum, nil, handlerVars)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Luhn check could not be complete. "+err.Error(), http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
-	if !c {
-		http.Error(w, "Incorrect order number format.", http.StatusUnprocessableEntity)
+	w.WriteHeader(code)
+}
+
+const maxBatchOrders = 100
+
+const (
+	BatchOrderAccepted     = "accepted"
+	BatchOrderAlreadyYours = "already_yours"
+	BatchOrderOtherUser    = "owned_by_another_user"
+	BatchOrderInvalid      = "invalid_format"
+	BatchOrderError        = "error"
+)
+
+type BatchOrderResult struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+}
+
+func postOrdersBatchPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
 		return
 	}
 
-	code, err = uploadOrderNumber(loginID, orderNum, handlerVars.db)
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+		writeInternalError(w, err)
 		return
 	}
-	go updateOrder(r.Context(), loginID, orderNum, handlerVars)
-	w.WriteHeader(code)
+
+	var numbers []string
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(contentType, "application/json"):
+		err = json.Unmarshal(bodyBytes, &numbers)
+		if err != nil {
+			writeError(w, errInvalidJSON)
+			return
+		}
+	case strings.Contains(contentType, "text/plain"):
+		for _, line := range strings.Split(string(bodyBytes), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+	default:
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeUnsupportedContentType, "Request content type is not json or plain text."))
+		return
+	}
+	if len(numbers) == 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "No order numbers."))
+		return
+	}
+	if len(numbers) > maxBatchOrders {
+		writeError(w, NewAPIError(http.StatusRequestEntityTooLarge, CodeTooManyOrders,
+			fmt.Sprintf("Too many order numbers, at most %d are allowed.", maxBatchOrders)))
+		return
+	}
+
+	results := make([]BatchOrderResult, 0, len(numbers))
+	for _, orderNum := range numbers {
+		result := BatchOrderResult{Number: orderNum}
+		code, err := submitOrder(user.ID, orderNum, nil, handlerVars)
+		if err != nil {
+			sugar.Errorln(err.Error())
+		}
+		switch code {
+		case http.StatusAccepted:
+			result.Status = BatchOrderAccepted
+		case http.StatusOK:
+			result.Status = BatchOrderAlreadyYours
+		case http.StatusConflict:
+			result.Status = BatchOrderOtherUser
+		case http.StatusUnprocessableEntity:
+			result.Status = BatchOrderInvalid
+		default:
+			result.Status = BatchOrderError
+		}
+		results = append(results, result)
+	}
+
+	respJSON, err := json.Marshal(&results)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(respJSON)
+}
+
+// submitOrder проверяет номер заказа, привязывает его к пользователю и запускает опрос системы начислений.
+// apiKeyID — ключ сервиса, загрузившего заказ за пользователя, или nil.
+func submitOrder(loginID int, orderNum string, apiKeyID *int, handlerVars *HandlerVars) (int, error) {
+	c, err := CheckLuhn(orderNum)
+	if err != nil || !c {
+		return http.StatusUnprocessableEntity, errInvalidOrderNumber
+	}
+
+	code, err := uploadOrderNumber(loginID, orderNum, apiKeyID, handlerVars.db)
+	if err != nil {
+		return code, err
+	}
+	if code == http.StatusAccepted {
+		go updateOrder(handlerVars.ctx, loginID, orderNum, handlerVars)
+	}
+	return code, nil
 }
 
 func getOrdersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	code, loginID, err := authorization(auth, handlerVars.db)
+	filter, err := parseOrdersFilter(r.URL.Query())
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
 		return
 	}
 
-	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetOrdersInfo(loginID))
+	if checkNotModified(w, r, handlerVars, user.ID) {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetOrdersInfo(user.ID, filter))
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
-	orderInfo := obj.(*[]OrderInfo)
-	if len(*orderInfo) == 0 {
-		http.Error(w, "No order info.", http.StatusNoContent)
+	ordersPage := obj.(*OrdersPage)
+	if len(ordersPage.Orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	setNextPageLink(w, r, ordersPage.Next)
 
-	respJSON, err := json.Marshal(&orderInfo)
+	respJSON, err := json.Marshal(&ordersPage.Orders)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Response from database coult not be marshaled to json. "+err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 
@@ -358,32 +644,130 @@ func getOrdersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	w.Write(respJSON)
 }
 
-func balancePage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+var orderStatuses = []string{"NEW", "REGISTERED", "PROCESSING", "INVALID", "PROCESSED"}
+
+// parseOrdersFilter разбирает параметры GET /api/user/orders. Без параметров выдаются все заказы по возрастанию uploaded_at.
+func parseOrdersFilter(query url.Values) (*OrdersFilter, error) {
+	pageParams, err := parsePageParams(query, false)
+	if err != nil {
+		return nil, err
+	}
+	filter := OrdersFilter{PageParams: *pageParams}
+
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			known := false
+			for _, s := range orderStatuses {
+				if s == status {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return nil, errors.New("unknown order status: " + status)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	return &filter, nil
+}
+
+func getOrderPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	code, loginID, err := authorization(auth, handlerVars.db)
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	orderNum := ps.ByName("number")
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetOrderDetails(orderNum))
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+		writeInternalError(w, err)
+		return
+	}
+	order := obj.(*OrderDetails)
+	if order == nil {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeOrderNotFound, "Order not found."))
+		return
+	}
+	if order.LoginID != user.ID {
+		writeError(w, NewAPIError(http.StatusForbidden, CodeOrderOwnedByAnotherUser, "Order belongs to another user."))
+		return
+	}
+
+	if r.URL.Query().Get("refresh") == "true" && !isFinalOrderStatus(order.Status) {
+		_, err = checkAccrual(user.ID, orderNum, handlerVars)
+		if err != nil {
+			sugar.Errorln(err.Error())
+			writeError(w, errAccrualUnavailable)
+			return
+		}
+		obj, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetOrderDetails(orderNum))
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		order = obj.(*OrderDetails)
+	}
+
+	writeJSON(w, order)
+}
+
+func balancePage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	balanceQuery := handlerVars.db.GetBalanceInfo(user.ID)
+	current := true
+	if v := r.URL.Query().Get("at"); v != "" {
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "at must be an RFC3339 timestamp"))
+			return
+		}
+		balanceQuery = handlerVars.db.GetBalanceAt(user.ID, at)
+		current = false
+	}
+
+	if checkNotModified(w, r, handlerVars, user.ID) {
 		return
 	}
 
-	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetBalanceInfo(loginID))
+	obj, err := Retrypg(pgerrcode.ConnectionException, balanceQuery)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 	balanceInfo := obj.(*BalanceInfo)
 
+	if current {
+		obj, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetExpiringPoints(user.ID, expiringPointsLimit))
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		balanceInfo.ExpiringSoon = obj.([]ExpiringPoints)
+	}
+
 	respJSON, err := json.Marshal(&balanceInfo)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Response from database coult not be marshaled to json. "+err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 
@@ -398,104 +782,195 @@ type WithdrawInfo struct {
 	Sum   float32 `json:"sum"`
 }
 
-func withdrawBalance(loginID int, order string, sum float32, db *DBConnection) (int, error) {
-	obj, err := Retrypg(pgerrcode.ConnectionException, db.WithdrawBalance(loginID, order, sum))
+func withdrawBalance(loginID int, order string, sum float32, handlerVars *HandlerVars) error {
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.WithdrawBalance(loginID, order, sum))
 	if err != nil {
-		sugar.Errorln(err.Error())
-		return http.StatusInternalServerError, err
+		return err
 	}
 	success := obj.(bool)
 	if !success {
-		err := errors.New("not enough balance")
-		return http.StatusPaymentRequired, err
+		return errInsufficientFunds
 	}
-	return http.StatusOK, nil
+	publishEvent(handlerVars, loginID, EventWithdrawalCompleted, &PointsEvent{Order: order, Sum: sum})
+	return nil
 }
 
 func balanceWithdrawPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		http.Error(w, "Request content type is not json!", http.StatusBadRequest)
+		writeError(w, errNotJSON)
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	code, loginID, err := authorization(auth, handlerVars.db)
-	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
 		return
 	}
 
 	var withdrawInfo *WithdrawInfo
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not read request body!", http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
 	err = json.Unmarshal(bodyBytes, &withdrawInfo)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Could not unmarshal withdraw info!", http.StatusBadRequest)
+		writeError(w, errInvalidJSON)
 		return
 	}
 
 	c, err := CheckLuhn(withdrawInfo.Order)
-	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Luhn check could not be complete. "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if !c {
-		http.Error(w, "Incorrect order number format.", http.StatusUnprocessableEntity)
+	if err != nil || !c {
+		writeError(w, errInvalidOrderNumber)
 		return
 	}
 
-	code, err = withdrawBalance(loginID, withdrawInfo.Order, withdrawInfo.Sum, handlerVars.db)
+	err = withdrawBalance(user.ID, withdrawInfo.Order, withdrawInfo.Sum, handlerVars)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+		respondError(w, err)
 		return
 	}
-	w.WriteHeader(code)
+	w.WriteHeader(http.StatusOK)
 }
 
 func withdrawalsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
 	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	code, loginID, err := authorization(auth, handlerVars.db)
+	filter, err := parseWithdrawalsFilter(r.URL.Query())
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), code)
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if checkNotModified(w, r, handlerVars, user.ID) {
 		return
 	}
 
-	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetWithdrawalsInfo(loginID))
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetWithdrawalsInfo(user.ID, filter))
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, err)
 		return
 	}
-	withdrawalsInfo := obj.(*[]WithdrawalsInfo)
-	sugar.Infoln(withdrawalsInfo)
-	respJSON, err := json.Marshal(&withdrawalsInfo)
+	writeWithdrawalsPage(w, r, obj.(*WithdrawalsPage))
+}
+
+// parseWithdrawalsFilter разбирает параметры GET /api/user/withdrawals. Без параметров выдаются все списания, новые первыми.
+func parseWithdrawalsFilter(query url.Values) (*WithdrawalsFilter, error) {
+	pageParams, err := parsePageParams(query, true)
 	if err != nil {
-		sugar.Errorln(err.Error())
-		http.Error(w, "Response from database coult not be marshaled to json. "+err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	filter := WithdrawalsFilter{PageParams: *pageParams}
+
+	if v := query.Get("min_sum"); v != "" {
+		sum, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return nil, errors.New("min_sum must be a number")
+		}
+		minSum := float32(sum)
+		filter.MinSum = &minSum
+	}
+	if v := query.Get("max_sum"); v != "" {
+		sum, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return nil, errors.New("max_sum must be a number")
+		}
+		maxSum := float32(sum)
+		filter.MaxSum = &maxSum
+	}
+	return &filter, nil
+}
+
+// withdrawalsPageProfile в заголовке Accept заменяет ответ-массив на объект с итогами и курсором.
+const withdrawalsPageProfile = "profile=page"
+
+type WithdrawalsPageAnswer struct {
+	Withdrawals []WithdrawalsInfo `json:"withdrawals"`
+	TotalCount  int               `json:"total_count"`
+	TotalSum    float64           `json:"total_sum"`
+	NextCursor  string            `json:"next_cursor,omitempty"`
+}
+
+// writeWithdrawalsPage отдаёт итоги по отфильтрованному диапазону в заголовках X-Total-Count и X-Total-Sum
+// либо, если клиент запросил профиль page, в объекте-обёртке.
+func writeWithdrawalsPage(w http.ResponseWriter, r *http.Request, page *WithdrawalsPage) {
+	setNextPageLink(w, r, page.Next)
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.TotalCount))
+	w.Header().Set("X-Total-Sum", strconv.FormatFloat(page.TotalSum, 'f', -1, 64))
+
+	var body interface{} = &page.Withdrawals
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), withdrawalsPageProfile) {
+		answer := WithdrawalsPageAnswer{
+			Withdrawals: page.Withdrawals,
+			TotalCount:  page.TotalCount,
+			TotalSum:    page.TotalSum,
+		}
+		if answer.Withdrawals == nil {
+			answer.Withdrawals = []WithdrawalsInfo{}
+		}
+		if page.Next != nil {
+			answer.NextCursor = page.Next.Encode()
+		}
+		body = &answer
+		contentType = "application/json; " + withdrawalsPageProfile
+	}
+
+	respJSON, err := json.Marshal(body)
+	if err != nil {
+		writeInternalError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 	sugar.Infoln(string(respJSON))
 	w.Write(respJSON)
 }
+
+// adjustmentsPage отдаёт корректировки отдельным списком: /api/user/withdrawals остаётся историей списаний по заказам,
+// а в хронологии вместе с остальными операциями корректировки видны в выписке (statementPage).
+func adjustmentsPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetAdjustmentsInfo(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	adjustmentsInfo := obj.(*[]AdjustmentInfo)
+	if len(*adjustmentsInfo) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for i := range *adjustmentsInfo {
+		(*adjustmentsInfo)[i].AdminID = 0
+	}
+	writeJSON(w, adjustmentsInfo)
+}
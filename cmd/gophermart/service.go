@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// POST /api/service/orders — регистрация номера заказа от имени пользователя сервисом магазина (orders:write);
+// POST /api/service/withdrawals/:order/reverse — возврат баллов, списанных в счёт отменённого заказа (withdrawals:reverse);
+//   сервису доступны только списания пользователей, чьи заказы он регистрировал через POST /api/service/orders.
+
+func registerServiceRoutes(router *httprouter.Router, handlerVars *HandlerVars) {
+	router.POST("/api/service/orders", serviceRoute(serviceOrdersPage, handlerVars, ScopeOrdersWrite))
+	router.POST("/api/service/withdrawals/:order/reverse", serviceRoute(serviceReverseWithdrawalPage, handlerVars, ScopeWithdrawalsReverse))
+}
+
+type ServiceOrderInfo struct {
+	Login string `json:"login"`
+	Order string `json:"order"`
+}
+
+func serviceOrdersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	key, ok := ServiceKeyFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var orderInfo ServiceOrderInfo
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &orderInfo)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetUserInfo(orderInfo.Login))
+	if err != nil {
+		if errors.Is(err, ErrLoginNotExist) {
+			writeError(w, errUserNotFound)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+	userInfo := obj.(*UserInfo)
+	if userInfo.Disabled {
+		writeError(w, errAccountDisabled)
+		return
+	}
+
+	code, err := submitOrder(userInfo.ID, orderInfo.Order, &key.ID, handlerVars)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	sugar.Infoln("api key", key.ID, "submitted order", orderInfo.Order, "for user", userInfo.ID)
+	w.WriteHeader(code)
+}
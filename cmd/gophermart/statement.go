@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	statementFormatJSON = "json"
+	statementFormatCSV  = "csv"
+)
+
+// StatementQuery — параметры GET /api/user/statement. Период полуоткрытый: [From, To).
+type StatementQuery struct {
+	From   time.Time
+	To     time.Time
+	Format string
+}
+
+// parseStatementQuery разбирает from, to (RFC3339) и format. Без from выписка начинается с первой операции, без to — заканчивается сейчас.
+func parseStatementQuery(query url.Values, now time.Time) (*StatementQuery, error) {
+	sq := StatementQuery{To: now, Format: statementFormatJSON}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		sq.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("from must be an RFC3339 timestamp")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		sq.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("to must be an RFC3339 timestamp")
+		}
+	}
+	if !sq.From.Before(sq.To) {
+		return nil, errors.New("from must be before to")
+	}
+
+	switch v := query.Get("format"); v {
+	case "", statementFormatJSON:
+	case statementFormatCSV:
+		sq.Format = statementFormatCSV
+	default:
+		return nil, errors.New("format must be csv or json")
+	}
+	return &sq, nil
+}
+
+// roundPoints убирает погрешность сложения float: баллы считаются с точностью до сотых.
+func roundPoints(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// PointsTotals — обороты по типам операций. Общие для выписки и дневной истории баланса,
+// чтобы новые типы операций попадали в оба отчёта одинаково.
+type PointsTotals struct {
+	Accrued     float64 `json:"accrued"`
+	Bonus       float64 `json:"bonus"`
+	Referral    float64 `json:"referral"`
+	Transferred float64 `json:"transferred"`
+	Withdrawn   float64 `json:"withdrawn"`
+	Reversed    float64 `json:"reversed"`
+	Adjusted    float64 `json:"adjusted"`
+	Expired     float64 `json:"expired"`
+}
+
+// accumulate относит операцию к её обороту. Списания и сгорания копятся положительными суммами.
+func (t *PointsTotals) accumulate(e *StatementEntry) {
+	switch e.Type {
+	case StatementAccrual:
+		t.Accrued += e.Amount
+	case StatementBonus:
+		t.Bonus += e.Amount
+	case StatementReferral:
+		t.Referral += e.Amount
+	case StatementTransfer:
+		t.Transferred += e.Amount
+	case StatementWithdrawal:
+		t.Withdrawn -= e.Amount
+	case StatementReversal:
+		t.Reversed += e.Amount
+	case StatementAdjustment:
+		t.Adjusted += e.Amount
+	case StatementExpiration:
+		t.Expired -= e.Amount
+	}
+}
+
+func (t *PointsTotals) round() {
+	t.Accrued = roundPoints(t.Accrued)
+	t.Bonus = roundPoints(t.Bonus)
+	t.Referral = roundPoints(t.Referral)
+	t.Transferred = roundPoints(t.Transferred)
+	t.Withdrawn = roundPoints(t.Withdrawn)
+	t.Reversed = roundPoints(t.Reversed)
+	t.Adjusted = roundPoints(t.Adjusted)
+	t.Expired = roundPoints(t.Expired)
+}
+
+// StatementSummary — итоги выписки за период.
+type StatementSummary struct {
+	PointsTotals
+	ClosingBalance float64 `json:"closing_balance"`
+}
+
+type StatementLine struct {
+	Type    string  `json:"type"`
+	Order   string  `json:"order,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+	Amount  float64 `json:"amount"`
+	Balance float64 `json:"balance"`
+	At      string  `json:"at"`
+}
+
+// statementEncoder пишет выписку в тело ответа по мере чтения операций из базы.
+type statementEncoder interface {
+	Opening(sq *StatementQuery, balance float64) error
+	Line(line *StatementLine) error
+	Closing(sq *StatementQuery, summary *StatementSummary) error
+}
+
+// jsonStatementEncoder собирает объект
+// {"from", "to", "opening_balance", "entries": [...], "summary": {...}} без буферизации всех строк.
+type jsonStatementEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonStatementEncoder) Opening(sq *StatementQuery, balance float64) error {
+	head, err := json.Marshal(struct {
+		From           string  `json:"from,omitempty"`
+		To             string  `json:"to"`
+		OpeningBalance float64 `json:"opening_balance"`
+	}{formatStatementTime(sq.From), formatStatementTime(sq.To), balance})
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(head[:len(head)-1], `,"entries":[`...))
+	return err
+}
+
+func (e *jsonStatementEncoder) Line(line *StatementLine) error {
+	lineJSON, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		lineJSON = append([]byte{','}, lineJSON...)
+	}
+	e.count++
+	_, err = e.w.Write(lineJSON)
+	return err
+}
+
+func (e *jsonStatementEncoder) Closing(sq *StatementQuery, summary *StatementSummary) error {
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(append([]byte(`],"summary":`), summaryJSON...), '}'))
+	return err
+}
+
+// csvStatementEncoder пишет строки at,type,order,reason,amount,balance.
+// Первая строка после заголовка — входящий остаток (type=opening), последняя — исходящий (type=closing).
+type csvStatementEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvStatementEncoder) Opening(sq *StatementQuery, balance float64) error {
+	e.w.Write([]string{"at", "type", "order", "reason", "amount", "balance"})
+	e.w.Write([]string{formatStatementTime(sq.From), "opening", "", "", "", formatPoints(balance)})
+	return e.w.Error()
+}
+
+func (e *csvStatementEncoder) Line(line *StatementLine) error {
+	e.w.Write([]string{line.At, line.Type, line.Order, line.Reason, formatPoints(line.Amount), formatPoints(line.Balance)})
+	return e.w.Error()
+}
+
+func (e *csvStatementEncoder) Closing(sq *StatementQuery, summary *StatementSummary) error {
+	e.w.Write([]string{formatStatementTime(sq.To), "closing", "", "", "", formatPoints(summary.ClosingBalance)})
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func formatPoints(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// formatStatementTime оставляет пустую строку для незаданного начала периода.
+func formatStatementTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func statementPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	sq, err := parseStatementQuery(r.URL.Query(), time.Now().UTC())
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	var encoder statementEncoder
+	contentType := "application/json"
+	switch sq.Format {
+	case statementFormatCSV:
+		encoder = &csvStatementEncoder{w: csv.NewWriter(w)}
+		contentType = "text/csv; charset=utf-8"
+		w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+	default:
+		encoder = &jsonStatementEncoder{w: w}
+	}
+
+	var summary StatementSummary
+	var balance float64
+	started := false
+	opening := func(openingBalance float64) error {
+		balance = openingBalance
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		return encoder.Opening(sq, roundPoints(balance))
+	}
+	entry := func(e *StatementEntry) error {
+		balance += e.Amount
+		summary.accumulate(e)
+		return encoder.Line(&StatementLine{
+			Type:    e.Type,
+			Order:   e.Order,
+			Reason:  e.Reason,
+			Amount:  roundPoints(e.Amount),
+			Balance: roundPoints(balance),
+			At:      e.At.UTC().Format(time.RFC3339),
+		})
+	}
+
+	err = handlerVars.db.StreamStatement(r.Context(), user.ID, sq.From, sq.To, opening, entry)
+	if err == nil {
+		summary.round()
+		summary.ClosingBalance = roundPoints(balance)
+		err = encoder.Closing(sq, &summary)
+	}
+	if err != nil {
+		if !started {
+			writeInternalError(w, err)
+			return
+		}
+		// Статус уже отправлен: обрыв выписки без итоговой строки клиент увидит как неполный ответ.
+		sugar.Errorw(err.Error(), "request_id", w.Header().Get(requestIDHeader))
+	}
+}
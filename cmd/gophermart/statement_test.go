@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseStatementQuery(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		query   string
+		want    StatementQuery
+		wantErr bool
+	}{
+		{name: "defaults", query: "", want: StatementQuery{To: now, Format: statementFormatJSON}},
+		{name: "period", query: "from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z",
+			want: StatementQuery{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				To: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Format: statementFormatJSON}},
+		{name: "from only", query: "from=2024-06-01T00:00:00%2B03:00&format=csv",
+			want: StatementQuery{From: time.Date(2024, 5, 31, 21, 0, 0, 0, time.UTC), To: now, Format: statementFormatCSV}},
+		{name: "explicit json", query: "format=json", want: StatementQuery{To: now, Format: statementFormatJSON}},
+		{name: "bad from", query: "from=2024-01-01", wantErr: true},
+		{name: "bad to", query: "to=yesterday", wantErr: true},
+		{name: "from equals to", query: "from=2024-01-01T00:00:00Z&to=2024-01-01T00:00:00Z", wantErr: true},
+		{name: "from after to", query: "from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z", wantErr: true},
+		{name: "from in future", query: "from=2025-01-01T00:00:00Z", wantErr: true},
+		{name: "unknown format", query: "format=xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseStatementQuery(query, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStatementQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !got.From.Equal(tt.want.From) || !got.To.Equal(tt.want.To) || got.Format != tt.want.Format {
+				t.Errorf("parseStatementQuery() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPointsTotalsAccumulate(t *testing.T) {
+	entries := []StatementEntry{
+		{Type: StatementAccrual, Amount: 100.1},
+		{Type: StatementAccrual, Amount: 0.2},
+		{Type: StatementBonus, Amount: 10},
+		{Type: StatementReferral, Amount: 5},
+		{Type: StatementTransfer, Amount: -7.5},
+		{Type: StatementTransfer, Amount: 2.5},
+		{Type: StatementWithdrawal, Amount: -30},
+		{Type: StatementReversal, Amount: 12},
+		{Type: StatementAdjustment, Amount: -3},
+		{Type: StatementExpiration, Amount: -4.25},
+		{Type: "unknown", Amount: 1000},
+	}
+	var totals PointsTotals
+	for i := range entries {
+		totals.accumulate(&entries[i])
+	}
+	totals.round()
+
+	want := PointsTotals{Accrued: 100.3, Bonus: 10, Referral: 5, Transferred: -5, Withdrawn: 30,
+		Reversed: 12, Adjusted: -3, Expired: 4.25}
+	if totals != want {
+		t.Errorf("accumulate() = %+v, want %+v", totals, want)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultLoyaltyTiers   = "Standard:0,Silver:1000,Gold:5000,Platinum:20000"
+	defaultTierWindowDays = 365
+	tierReviewInterval    = 24 * time.Hour
+)
+
+type Tier struct {
+	Name      string
+	Threshold float64
+}
+
+// TierPolicy — уровни лояльности по возрастанию порога и длина скользящего окна, за которое суммируются начисления.
+// Первый уровень всегда с нулевым порогом: его получают все пользователи.
+type TierPolicy struct {
+	Tiers  []Tier
+	Window time.Duration
+}
+
+// ParseTierPolicy разбирает список уровней вида "Standard:0,Silver:1000,Gold:5000".
+func ParseTierPolicy(spec string, windowDays int) (*TierPolicy, error) {
+	if windowDays <= 0 {
+		return nil, errors.New("tier window must be a positive number of days")
+	}
+	policy := TierPolicy{Window: time.Duration(windowDays) * 24 * time.Hour}
+	names := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" {
+			return nil, fmt.Errorf("tier %q must look like Name:threshold", part)
+		}
+		name := strings.TrimSpace(fields[0])
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("tier %s threshold must be a non-negative number", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("tier %s is listed twice", name)
+		}
+		names[name] = true
+		policy.Tiers = append(policy.Tiers, Tier{Name: name, Threshold: threshold})
+	}
+	sort.SliceStable(policy.Tiers, func(i, j int) bool {
+		return policy.Tiers[i].Threshold < policy.Tiers[j].Threshold
+	})
+	if policy.Tiers[0].Threshold != 0 {
+		return nil, errors.New("the lowest tier must have threshold 0")
+	}
+	for i := 1; i < len(policy.Tiers); i++ {
+		if policy.Tiers[i].Threshold == policy.Tiers[i-1].Threshold {
+			return nil, fmt.Errorf("tiers %s and %s have the same threshold", policy.Tiers[i-1].Name, policy.Tiers[i].Name)
+		}
+	}
+	return &policy, nil
+}
+
+func (p *TierPolicy) Base() string {
+	return p.Tiers[0].Name
+}
+
+// TierFor возвращает индекс уровня, которого достигает сумма начислений accrued.
+func (p *TierPolicy) TierFor(accrued float64) int {
+	current := 0
+	for i, tier := range p.Tiers {
+		if accrued >= tier.Threshold {
+			current = i
+		}
+	}
+	return current
+}
+
+type TierStatus struct {
+	Tier                string   `json:"tier"`
+	Accrued             float64  `json:"accrued"`
+	WindowDays          int      `json:"window_days"`
+	NextTier            string   `json:"next_tier,omitempty"`
+	NextTierThreshold   *float64 `json:"next_tier_threshold,omitempty"`
+	RemainingToNextTier *float64 `json:"remaining_to_next_tier,omitempty"`
+	// Progress — доля пути от порога текущего уровня до порога следующего, от 0 до 1.
+	Progress float64 `json:"progress"`
+}
+
+func (p *TierPolicy) status(accrued float64) *TierStatus {
+	i := p.TierFor(accrued)
+	status := TierStatus{
+		Tier:       p.Tiers[i].Name,
+		Accrued:    roundPoints(accrued),
+		WindowDays: int(p.Window / (24 * time.Hour)),
+		Progress:   1,
+	}
+	if i+1 < len(p.Tiers) {
+		next := p.Tiers[i+1]
+		remaining := roundPoints(next.Threshold - accrued)
+		status.NextTier = next.Name
+		status.NextTierThreshold = &next.Threshold
+		status.RemainingToNextTier = &remaining
+		status.Progress = math.Floor((accrued-p.Tiers[i].Threshold)/(next.Threshold-p.Tiers[i].Threshold)*100) / 100
+	}
+	return &status
+}
+
+// applyTier сохраняет уровень, соответствующий standing, и сообщает пользователю о переходе.
+func applyTier(handlerVars *HandlerVars, standing *TierStanding) (*TierStatus, error) {
+	policy := handlerVars.Tiers
+	status := policy.status(standing.Accrued)
+	stored := standing.Tier
+	if stored == "" {
+		stored = policy.Base()
+	}
+	if stored == status.Tier {
+		return status, nil
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.ChangeUserTier(standing.LoginID, status.Tier, policy.Base(), standing.Accrued))
+	if err != nil {
+		return nil, err
+	}
+	if change := obj.(*TierChange); change != nil {
+		sugar.Infoln("user", standing.LoginID, "moved from tier", change.From, "to", change.To)
+		publishEvent(handlerVars, standing.LoginID, EventTierChanged, change)
+	}
+	return status, nil
+}
+
+// evaluateTier пересчитывает уровень пользователя по начислениям за окно, заканчивающееся сейчас.
+func evaluateTier(handlerVars *HandlerVars, loginID int) (*TierStatus, error) {
+	since := time.Now().UTC().Add(-handlerVars.Tiers.Window)
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetTierStanding(loginID, since))
+	if err != nil {
+		return nil, err
+	}
+	return applyTier(handlerVars, obj.(*TierStanding))
+}
+
+// runTierReviewWorker раз в tierReviewInterval пересчитывает уровни всех пользователей:
+// старые начисления выходят из окна, и уровень может понизиться без новых заказов.
+func runTierReviewWorker(ctx context.Context, handlerVars *HandlerVars) {
+	ticker := time.NewTicker(tierReviewInterval)
+	defer ticker.Stop()
+	for {
+		reviewTiers(handlerVars)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reviewTiers(handlerVars *HandlerVars) {
+	since := time.Now().UTC().Add(-handlerVars.Tiers.Window)
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetTierStandings(since))
+	if err != nil {
+		sugar.Errorln("Could not review tiers. " + err.Error())
+		return
+	}
+	for _, standing := range obj.([]TierStanding) {
+		_, err := applyTier(handlerVars, &standing)
+		if err != nil {
+			sugar.Errorln("Could not update tier of user", standing.LoginID, err.Error())
+		}
+	}
+}
+
+func tierPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	status, err := evaluateTier(handlerVars, user.ID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func tierHistoryPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetTierChanges(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	changes := obj.([]TierChange)
+	if len(changes) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, changes)
+}
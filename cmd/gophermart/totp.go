@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Параметры TOTP по RFC 6238, которые понимают все распространённые приложения-аутентификаторы.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+	totpIssuer = "Gophermart"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func TOTPURI(login, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + login)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("period", fmt.Sprint(totpPeriod))
+	params.Set("digits", fmt.Sprint(totpDigits))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// CheckTOTP сверяет код с секретом с допуском в totpSkew шагов и возвращает совпавший шаг.
+// Шаг нужен вызывающему, чтобы не принять один и тот же код повторно.
+func CheckTOTP(secret, code string, t time.Time) (int64, bool, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false, err
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// GenerateRecoveryCodes создаёт одноразовые коды восстановления вида xxxxx-xxxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 5)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, err
+		}
+		code := fmt.Sprintf("%x", raw)
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
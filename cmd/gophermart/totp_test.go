@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret — ключ "12345678901234567890" из тестовых векторов RFC 6238 в base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCheckTOTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		at       int64
+		wantStep int64
+		wantOK   bool
+		wantErr  bool
+	}{
+		{name: "rfc vector 59", secret: rfc6238Secret, code: "287082", at: 59, wantStep: 1, wantOK: true},
+		{name: "rfc vector 1111111109", secret: rfc6238Secret, code: "081804", at: 1111111109, wantStep: 37037036, wantOK: true},
+		{name: "rfc vector 1234567890", secret: rfc6238Secret, code: "005924", at: 1234567890, wantStep: 41152263, wantOK: true},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "287082", at: 59, wantStep: 1, wantOK: true},
+		{name: "previous step within skew", secret: rfc6238Secret, code: "287082", at: 89, wantStep: 1, wantOK: true},
+		{name: "next step within skew", secret: rfc6238Secret, code: "287082", at: 15, wantStep: 1, wantOK: true},
+		{name: "beyond skew", secret: rfc6238Secret, code: "287082", at: 119},
+		{name: "wrong code", secret: rfc6238Secret, code: "000000", at: 59},
+		{name: "empty code", secret: rfc6238Secret, code: "", at: 59},
+		{name: "invalid secret", secret: "not base32!", code: "287082", at: 59, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok, err := CheckTOTP(tt.secret, tt.code, time.Unix(tt.at, 0))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckTOTP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("CheckTOTP() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && step != tt.wantStep {
+				t.Errorf("CheckTOTP() step = %d, want %d", step, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestCheckTOTPGeneratedSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	code := totpCode(key, now.Unix()/totpPeriod)
+	step, ok, err := CheckTOTP(secret, code, now)
+	if err != nil || !ok || step != now.Unix()/totpPeriod {
+		t.Errorf("CheckTOTP() = %d, %v, %v; want %d, true, nil", step, ok, err, now.Unix()/totpPeriod)
+	}
+}
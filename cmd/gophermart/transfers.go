@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultTransferDailyLimit  = 10000
+	defaultTransferDailyCount  = 10
+	defaultTransferConfirmOver = 1000
+	// transferConfirmTTL — сколько перевод ждёт подтверждения отправителем.
+	transferConfirmTTL    = 15 * time.Minute
+	maxTransferCommentLen = 200
+)
+
+type TransferRequest struct {
+	To      string  `json:"to"`
+	Sum     float64 `json:"sum"`
+	Comment string  `json:"comment"`
+}
+
+type TransferEvent struct {
+	ID        int     `json:"id"`
+	Direction string  `json:"direction"`
+	Login     string  `json:"login"`
+	Sum       float64 `json:"sum"`
+}
+
+// transferError переводит результат проведения перевода в ответ клиенту.
+func transferError(outcome string) *APIError {
+	switch outcome {
+	case TransferNotFound:
+		return NewAPIError(http.StatusNotFound, CodeNotFound, "Transfer not found.")
+	case TransferNotPending:
+		return NewAPIError(http.StatusConflict, CodeTransferNotPending, "Transfer is already completed or expired.")
+	case TransferRecipientDisabled:
+		return errUserNotFound
+	case TransferInsufficientFunds:
+		return errInsufficientFunds
+	case TransferLimitExceeded:
+		return NewAPIError(http.StatusUnprocessableEntity, CodeTransferLimitExceeded, "Daily transfer limit exceeded.")
+	default:
+		return errInternal
+	}
+}
+
+// publishTransfer сообщает о проведённом переводе обеим сторонам.
+func publishTransfer(handlerVars *HandlerVars, sender *User, t *Transfer) {
+	sugar.Infoln("user", sender.ID, "transferred", t.Sum, "to user", t.ToID)
+	publishEvent(handlerVars, sender.ID, EventTransferCompleted,
+		&TransferEvent{ID: t.ID, Direction: TransferOutgoing, Login: t.Login, Sum: t.Sum})
+	publishEvent(handlerVars, t.ToID, EventTransferCompleted,
+		&TransferEvent{ID: t.ID, Direction: TransferIncoming, Login: sender.Login, Sum: t.Sum})
+}
+
+func transferPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	var req TransferRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if req.Sum <= 0 {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "sum must be positive."))
+		return
+	}
+	if len(req.Comment) > maxTransferCommentLen {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "comment is too long."))
+		return
+	}
+	if req.To == user.Login {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Cannot transfer points to yourself."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetUserInfo(req.To))
+	if err != nil {
+		if errors.Is(err, ErrLoginNotExist) {
+			writeError(w, errUserNotFound)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+	userInfo := obj.(*UserInfo)
+	if userInfo.Disabled {
+		writeError(w, errUserNotFound)
+		return
+	}
+
+	// Крупный перевод не проводится сразу: отправитель подтверждает его отдельным запросом.
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if handlerVars.TransferConfirmOver > 0 && req.Sum > handlerVars.TransferConfirmOver {
+		deadline := now.Add(transferConfirmTTL)
+		expiresAt = &deadline
+	}
+	t := Transfer{FromID: user.ID, ToID: userInfo.ID, Direction: TransferOutgoing, Login: userInfo.Login,
+		Sum: req.Sum, Comment: req.Comment}
+	obj, err = Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.CreateTransfer(t, &handlerVars.TransferLimits, now, expiresAt))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	result := obj.(*TransferResult)
+	if result.Outcome != TransferOK {
+		writeError(w, transferError(result.Outcome))
+		return
+	}
+
+	respJSON, err := json.Marshal(result.Transfer)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if expiresAt != nil {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		publishTransfer(handlerVars, user, result.Transfer)
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(respJSON)
+}
+
+// confirmTransferPage проводит ожидающий перевод. Пользователь с включённым вторым фактором подтверждает его кодом.
+func confirmTransferPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	transferID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect transfer id."))
+		return
+	}
+
+	required, err := secondFactorRequired(user.ID, handlerVars.db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if required {
+		info, ok := readSecondFactorInfo(w, r)
+		if !ok {
+			return
+		}
+		valid, err := verifySecondFactor(user.ID, info.Code, handlerVars.db)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if !valid {
+			writeError(w, errInvalidSecondFactor)
+			return
+		}
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.ConfirmTransfer(user.ID, transferID, &handlerVars.TransferLimits, time.Now().UTC()))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	result := obj.(*TransferResult)
+	if result.Outcome != TransferOK {
+		writeError(w, transferError(result.Outcome))
+		return
+	}
+	publishTransfer(handlerVars, user, result.Transfer)
+	writeJSON(w, result.Transfer)
+}
+
+func transfersPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetTransfers(user.ID, time.Now().UTC()))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	transfers := obj.([]Transfer)
+	if len(transfers) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, transfers)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+	recoveryCodesCount        = 10
+	// Не больше secondFactorMaxFailures неверных кодов за secondFactorFailureWindow на пользователя:
+	// лимит попыток одного challenge обходится повторным входом по паролю.
+	secondFactorMaxFailures   = 10
+	secondFactorFailureWindow = 15 * time.Minute
+)
+
+// SecondFactorChallenge — ответ с ошибкой SECOND_FACTOR_REQUIRED, дополненный challenge для POST /api/user/login/2fa.
+type SecondFactorChallenge struct {
+	ErrorResponse
+	Challenge string `json:"challenge"`
+}
+
+var (
+	errSecondFactorRequired = NewAPIError(http.StatusUnauthorized, CodeSecondFactorRequired, "Second factor required.")
+	errSecondFactorLocked   = NewAPIError(http.StatusTooManyRequests, CodeSecondFactorLocked,
+		"Too many wrong codes, try again later.")
+)
+
+// issueLoginChallenge отвечает на верный пароль пользователя с включённым вторым фактором.
+// Токен авторизации выдаётся только после проверки кода в loginSecondFactorPage.
+func issueLoginChallenge(w http.ResponseWriter, loginID int, db *DBConnection) {
+	challenge, err := createLoginChallenge(loginID, db)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", "TOTP")
+	writeErrorBody(w, errSecondFactorRequired.Status,
+		&SecondFactorChallenge{ErrorResponse: newErrorResponse(w, errSecondFactorRequired), Challenge: challenge})
+}
+
+// secondFactorRequired сообщает, включён ли у пользователя подтверждённый второй фактор.
+func secondFactorRequired(loginID int, db *DBConnection) (bool, error) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.GetTOTP(loginID))
+	if err != nil {
+		return false, err
+	}
+	totpInfo := obj.(*TOTPInfo)
+	return totpInfo != nil && totpInfo.Confirmed, nil
+}
+
+// secondFactorLocked сообщает, исчерпан ли лимит неверных кодов в текущем окне.
+func secondFactorLocked(totpInfo *TOTPInfo, now time.Time) bool {
+	return totpInfo.FailedAttempts >= secondFactorMaxFailures &&
+		totpInfo.FailuresSince.After(now.Add(-secondFactorFailureWindow))
+}
+
+// createLoginChallenge не выдаёт challenge, пока второй фактор заблокирован после неверных кодов.
+func createLoginChallenge(loginID int, db *DBConnection) (string, error) {
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.GetTOTP(loginID))
+	if err != nil {
+		return "", err
+	}
+	if totpInfo := obj.(*TOTPInfo); totpInfo != nil && secondFactorLocked(totpInfo, time.Now()) {
+		return "", errSecondFactorLocked
+	}
+
+	challenge, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = Retrypg(pgerrcode.ConnectionException,
+		db.CreateLoginChallenge(loginID, HashToken(challenge), time.Now().UTC().Add(loginChallengeTTL)))
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// verifySecondFactor принимает либо текущий код TOTP, либо неиспользованный код восстановления.
+// Неверный код засчитывается пользователю; после secondFactorMaxFailures возвращается errSecondFactorLocked.
+func verifySecondFactor(loginID int, code string, db *DBConnection) (bool, error) {
+	now := time.Now()
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.GetTOTP(loginID))
+	if err != nil {
+		return false, err
+	}
+	totpInfo := obj.(*TOTPInfo)
+	if totpInfo == nil || !totpInfo.Confirmed {
+		return false, nil
+	}
+	if secondFactorLocked(totpInfo, now) {
+		return false, errSecondFactorLocked
+	}
+
+	valid, err := checkSecondFactorCode(loginID, totpInfo, strings.TrimSpace(code), now, db)
+	if err != nil || valid {
+		return valid, err
+	}
+	_, err = Retrypg(pgerrcode.ConnectionException,
+		db.FailSecondFactor(loginID, now.UTC(), now.UTC().Add(-secondFactorFailureWindow)))
+	return false, err
+}
+
+func checkSecondFactorCode(loginID int, totpInfo *TOTPInfo, code string, now time.Time, db *DBConnection) (bool, error) {
+	if !isTOTPCode(code) {
+		obj, err := Retrypg(pgerrcode.ConnectionException, db.UseRecoveryCode(loginID, HashToken(strings.ToLower(code))))
+		if err != nil {
+			return false, err
+		}
+		return obj.(bool), nil
+	}
+
+	step, ok, err := CheckTOTP(totpInfo.Secret, code, now)
+	if err != nil || !ok {
+		return false, err
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.UseTOTPStep(loginID, step))
+	if err != nil {
+		return false, err
+	}
+	return obj.(bool), nil
+}
+
+type SecondFactorInfo struct {
+	Challenge string `json:"challenge,omitempty"`
+	Code      string `json:"code"`
+}
+
+func readSecondFactorInfo(w http.ResponseWriter, r *http.Request) (*SecondFactorInfo, bool) {
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return nil, false
+	}
+
+	var info SecondFactorInfo
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	err = json.Unmarshal(bodyBytes, &info)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return nil, false
+	}
+	if info.Code == "" {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Code is required."))
+		return nil, false
+	}
+	return &info, true
+}
+
+func loginSecondFactorPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	info, ok := readSecondFactorInfo(w, r)
+	if !ok {
+		return
+	}
+	token, err := passLoginChallenge(info.Challenge, info.Code, handlerVars.db)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	w.Header().Set("Authorization", token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// passLoginChallenge проверяет код второго фактора для challenge и выдаёт токен авторизации.
+// Неверный код расходует попытку, после loginChallengeMaxAttempts challenge перестаёт приниматься.
+func passLoginChallenge(challengeToken, code string, db *DBConnection) (string, error) {
+	challengeHash := HashToken(challengeToken)
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, db.GetLoginChallenge(challengeHash))
+	if err != nil {
+		return "", err
+	}
+	challenge := obj.(*LoginChallenge)
+	if challenge == nil || challenge.Attempts >= loginChallengeMaxAttempts {
+		return "", NewAPIError(http.StatusUnauthorized, CodeLoginChallengeExpired, "Login challenge expired.")
+	}
+
+	check, err := verifySecondFactor(challenge.LoginID, code, db)
+	if err != nil {
+		return "", err
+	}
+	if !check {
+		_, err = Retrypg(pgerrcode.ConnectionException, db.FailLoginChallenge(challengeHash))
+		if err != nil {
+			sugar.Errorln(err.Error())
+		}
+		return "", NewAPIError(http.StatusUnauthorized, CodeInvalidSecondFactor, "Wrong code.")
+	}
+
+	_, err = Retrypg(pgerrcode.ConnectionException, db.DeleteLoginChallenge(challengeHash))
+	if err != nil {
+		sugar.Errorln(err.Error())
+	}
+
+	obj, err = Retrypg(pgerrcode.ConnectionException, db.CreateAuthToken(challenge.Login, challenge.Hash))
+	if err != nil {
+		return "", fmt.Errorf("could not create authentication token: %w", err)
+	}
+	return obj.(string), nil
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func enrollTOTPPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.SaveTOTPSecret(user.ID, secret))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, errSecondFactorEnabled)
+		return
+	}
+
+	writeJSON(w, &TOTPEnrollment{Secret: secret, URI: TOTPURI(user.Login, secret)})
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func confirmTOTPPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	info, ok := readSecondFactorInfo(w, r)
+	if !ok {
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetTOTP(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	totpInfo := obj.(*TOTPInfo)
+	if totpInfo == nil {
+		writeError(w, NewAPIError(http.StatusConflict, CodeSecondFactorNotEnrolled, "Second factor enrollment not started."))
+		return
+	}
+	if totpInfo.Confirmed {
+		writeError(w, errSecondFactorEnabled)
+		return
+	}
+
+	step, check, err := CheckTOTP(totpInfo.Secret, strings.TrimSpace(info.Code), time.Now())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !check {
+		writeError(w, errInvalidSecondFactor)
+		return
+	}
+
+	codes, err := GenerateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, HashToken(code))
+	}
+	obj, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.ConfirmTOTP(user.ID, step, hashes))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, errSecondFactorEnabled)
+		return
+	}
+
+	// Токен, с которым включали второй фактор, отозван: дальше клиент входит заново уже с кодом.
+	writeJSON(w, &RecoveryCodes{RecoveryCodes: codes})
+}
+
+func disableTOTPPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	info, ok := readSecondFactorInfo(w, r)
+	if !ok {
+		return
+	}
+
+	check, err := verifySecondFactor(user.ID, info.Code, handlerVars.db)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if !check {
+		writeError(w, errInvalidSecondFactor)
+		return
+	}
+
+	_, err = Retrypg(pgerrcode.ConnectionException, handlerVars.db.DeleteTOTP(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecondFactorLocked(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		attempts int
+		since    time.Time
+		want     bool
+	}{
+		{name: "no failures", attempts: 0, since: time.Time{}},
+		{name: "below limit", attempts: secondFactorMaxFailures - 1, since: now.Add(-time.Minute)},
+		{name: "limit reached in window", attempts: secondFactorMaxFailures, since: now.Add(-time.Minute), want: true},
+		{name: "window expired", attempts: secondFactorMaxFailures, since: now.Add(-secondFactorFailureWindow)},
+		{name: "old failures", attempts: secondFactorMaxFailures + 5, since: now.Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &TOTPInfo{FailedAttempts: tt.attempts, FailuresSince: tt.since}
+			if got := secondFactorLocked(info, now); got != tt.want {
+				t.Errorf("secondFactorLocked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -44,6 +47,40 @@ func CheckPassword(password, encodedHash string) (bool, error) {
 	return subtle.ConstantTimeCompare(hash, comparisonHash) == 1, nil
 }
 
+func GenerateRandomToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// GenerateAPIKey создаёт случайный ключ для сервисных вызовов. В базе хранится только его хеш.
+func GenerateAPIKey() (string, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	return "gm_" + token, nil
+}
+
+// GenerateReferralCode создаёт короткий код приглашения из заглавных букв и цифр, удобный для ввода вручную.
+func GenerateReferralCode() (string, error) {
+	raw := make([]byte, 5)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(raw), nil
+}
+
+// HashToken возвращает хеш случайного токена для поиска в базе. Токен случайный, поэтому соль не нужна.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func CheckLuhn(number string) (bool, error) {
 	var sum int
 	sugar.Infoln(number)
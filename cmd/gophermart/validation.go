@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// openapi.json — контракт HTTP API. По нему же ValidationMiddleware проверяет входящие запросы,
+// поэтому при изменении обработчиков документ нужно обновлять вместе с ними.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+var apiSpec = mustLoadOpenAPI(openAPIDocument)
+
+// Schema — подмножество JSON Schema из OpenAPI 3.0, которое используется в openapi.json.
+type Schema struct {
+	Ref              string             `json:"$ref"`
+	Type             string             `json:"type"`
+	Format           string             `json:"format"`
+	Required         []string           `json:"required"`
+	Properties       map[string]*Schema `json:"properties"`
+	Items            *Schema            `json:"items"`
+	Enum             []interface{}      `json:"enum"`
+	MinLength        *int               `json:"minLength"`
+	MaxLength        *int               `json:"maxLength"`
+	Pattern          string             `json:"pattern"`
+	Minimum          *float64           `json:"minimum"`
+	Maximum          *float64           `json:"maximum"`
+	ExclusiveMinimum bool               `json:"exclusiveMinimum"`
+	MinItems         *int               `json:"minItems"`
+	MaxItems         *int               `json:"maxItems"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Operation struct {
+	Parameters  []Parameter  `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+type OpenAPI struct {
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+func mustLoadOpenAPI(doc []byte) *OpenAPI {
+	var spec OpenAPI
+	err := json.Unmarshal(doc, &spec)
+	if err != nil {
+		panic("Could not parse openapi.json. " + err.Error())
+	}
+	return &spec
+}
+
+// findOperation ищет операцию по методу и пути запроса. Статические сегменты пути важнее параметров.
+func (spec *OpenAPI) findOperation(method, path string) (*Operation, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var found *Operation
+	var foundParams map[string]string
+	bestScore := -1
+	for template, item := range spec.Paths {
+		op, ok := item[strings.ToLower(method)]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(strings.Trim(template, "/"), "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		score := 0
+		params := make(map[string]string)
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				params[part[1:len(part)-1]] = segments[i]
+				continue
+			}
+			if part != segments[i] {
+				score = -1
+				break
+			}
+			score++
+		}
+		if score > bestScore {
+			found, foundParams, bestScore = op, params, score
+		}
+	}
+	return found, foundParams
+}
+
+func (spec *OpenAPI) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = spec.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validator struct {
+	spec   *OpenAPI
+	errors []ValidationError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// validateValue проверяет значение, разобранное из JSON с UseNumber.
+func (v *validator) validateValue(field string, value interface{}, schema *Schema) {
+	schema = v.spec.resolve(schema)
+	if schema == nil {
+		return
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			v.fail(field, "must be an object")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				v.fail(joinField(field, name), "is required")
+			}
+		}
+		for name, propSchema := range schema.Properties {
+			if propValue, ok := obj[name]; ok {
+				v.validateValue(joinField(field, name), propValue, propSchema)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			v.fail(field, "must be an array")
+			return
+		}
+		if schema.MinItems != nil && len(arr) < *schema.MinItems {
+			v.fail(field, "must have at least %d items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(arr) > *schema.MaxItems {
+			v.fail(field, "must have at most %d items", *schema.MaxItems)
+		}
+		for i, item := range arr {
+			v.validateValue(fmt.Sprintf("%s[%d]", field, i), item, schema.Items)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			v.fail(field, "must be a string")
+			return
+		}
+		v.validateString(field, s, schema)
+	case "number", "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			v.fail(field, numberMessage(schema))
+			return
+		}
+		v.validateNumber(field, string(n), schema)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(field, "must be a boolean")
+		}
+	}
+}
+
+func (v *validator) validateString(field, s string, schema *Schema) {
+	length := len([]rune(s))
+	if schema.MinLength != nil && length < *schema.MinLength {
+		if *schema.MinLength == 1 {
+			v.fail(field, "must not be empty")
+		} else {
+			v.fail(field, "must be at least %d characters", *schema.MinLength)
+		}
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		v.fail(field, "must be at most %d characters", *schema.MaxLength)
+	}
+	if schema.Pattern != "" {
+		if matched, err := regexp.MatchString(schema.Pattern, s); err == nil && !matched {
+			v.fail(field, "must match %s", schema.Pattern)
+		}
+	}
+	switch schema.Format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			v.fail(field, "must be an RFC3339 timestamp")
+		}
+	case "date":
+		if _, err := time.Parse(dateLayout, s); err != nil {
+			v.fail(field, "must be a date in YYYY-MM-DD format")
+		}
+	case "uri":
+		if u, err := url.Parse(s); err != nil || !u.IsAbs() {
+			v.fail(field, "must be an absolute uri")
+		}
+	}
+	if len(schema.Enum) > 0 {
+		for _, e := range schema.Enum {
+			if e == s {
+				return
+			}
+		}
+		v.fail(field, "must be one of %v", schema.Enum)
+	}
+}
+
+func numberMessage(schema *Schema) string {
+	if schema.Type == "integer" {
+		return "must be an integer"
+	}
+	return "must be a number"
+}
+
+func (v *validator) validateNumber(field, raw string, schema *Schema) {
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		v.fail(field, numberMessage(schema))
+		return
+	}
+	if schema.Type == "integer" {
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			v.fail(field, numberMessage(schema))
+			return
+		}
+	}
+	if schema.Minimum != nil {
+		if schema.ExclusiveMinimum && n <= *schema.Minimum {
+			v.fail(field, "must be greater than %v", *schema.Minimum)
+		} else if !schema.ExclusiveMinimum && n < *schema.Minimum {
+			v.fail(field, "must be at least %v", *schema.Minimum)
+		}
+	}
+	if schema.Maximum != nil && n > *schema.Maximum {
+		v.fail(field, "must be at most %v", *schema.Maximum)
+	}
+}
+
+// validateParameter проверяет строковое значение параметра пути, запроса или заголовка.
+func (v *validator) validateParameter(field, raw string, schema *Schema) {
+	schema = v.spec.resolve(schema)
+	if schema == nil {
+		return
+	}
+	switch schema.Type {
+	case "integer", "number":
+		v.validateNumber(field, raw, schema)
+	case "boolean":
+		if raw != "true" && raw != "false" {
+			v.fail(field, "must be true or false")
+		}
+	default:
+		v.validateString(field, raw, schema)
+	}
+}
+
+func (v *validator) validateRequest(r *http.Request, op *Operation, pathParams map[string]string) ([]byte, error) {
+	for _, param := range op.Parameters {
+		var raw string
+		var present bool
+		switch param.In {
+		case "path":
+			raw, present = pathParams[param.Name]
+		case "query":
+			values, ok := r.URL.Query()[param.Name]
+			if ok && len(values) > 0 {
+				raw, present = values[0], true
+			}
+		case "header":
+			raw = r.Header.Get(param.Name)
+			present = raw != ""
+		}
+		if !present {
+			if param.Required {
+				v.fail(param.Name, "is required")
+			}
+			continue
+		}
+		v.validateParameter(param.Name, raw, param.Schema)
+	}
+
+	if op.RequestBody == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			v.fail("body", "is required")
+		}
+		return body, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	content, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		supported := make([]string, 0, len(op.RequestBody.Content))
+		for ct := range op.RequestBody.Content {
+			supported = append(supported, ct)
+		}
+		v.fail("Content-Type", "must be one of %v", supported)
+		return body, nil
+	}
+
+	if mediaType == "application/json" {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			v.fail("body", "must be valid json")
+			return body, nil
+		}
+		v.validateValue("", value, content.Schema)
+	} else {
+		v.validateParameter("body", string(body), content.Schema)
+	}
+	return body, nil
+}
+
+var errValidationFailed = NewAPIError(http.StatusBadRequest, CodeValidationFailed, "Request does not match the API schema.")
+
+// ValidationMiddleware сверяет запрос с openapi.json и отвечает 400 со списком нарушений,
+// не передавая запрос обработчику. Запросы к путям, которых нет в документе, пропускаются.
+func ValidationMiddleware(next httprouter.Handle) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		op, pathParams := apiSpec.findOperation(r.Method, r.URL.Path)
+		if op == nil {
+			next(w, r, ps)
+			return
+		}
+
+		v := validator{spec: apiSpec}
+		body, err := v.validateRequest(r, op, pathParams)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if len(v.errors) > 0 {
+			resp := newErrorResponse(w, errValidationFailed)
+			resp.Details = v.errors
+			writeErrorBody(w, http.StatusBadRequest, &resp)
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		next(w, r, ps)
+	})
+}
+
+func openAPIPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GET /api/user/webhooks — список вебхуков пользователя;
+// POST /api/user/webhooks — регистрация вебхука;
+// DELETE /api/user/webhooks/:id — удаление вебхука;
+// GET /api/user/webhooks/:id/deliveries — доставки вебхука с журналом попыток, status=pending|delivered|failed;
+// POST /api/user/webhooks/:id/deliveries/:delivery/redeliver — повторная доставка.
+
+const (
+	WebhookOrderProcessed = "order.processed"
+	WebhookOrderInvalid   = "order.invalid"
+	WebhookWithdrawal     = "withdrawal"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookPollInterval   = 2 * time.Second
+	webhookRequestTimeout = 10 * time.Second
+	webhookBaseBackoff    = 30 * time.Second
+	webhookMaxAttempts    = 8
+	webhookBatchSize      = 50
+	webhookMinSecretLen   = 16
+)
+
+func registerWebhookRoutes(router *httprouter.Router, handlerVars *HandlerVars) {
+	router.GET("/api/user/webhooks", authRoute(webhooksPage, handlerVars))
+	router.POST("/api/user/webhooks", authRoute(createWebhookPage, handlerVars))
+	router.DELETE("/api/user/webhooks/:id", authRoute(deleteWebhookPage, handlerVars))
+	router.GET("/api/user/webhooks/:id/deliveries", authRoute(webhookDeliveriesPage, handlerVars))
+	router.POST("/api/user/webhooks/:id/deliveries/:delivery/redeliver", authRoute(redeliverWebhookPage, handlerVars))
+}
+
+// webhookEventType сопоставляет внутреннее событие внешнему типу. Пустая строка — событие вебхукам не отправляется.
+func webhookEventType(eventType string, payload interface{}) string {
+	switch eventType {
+	case EventOrderStatusChanged:
+		order, ok := payload.(*OrderStatusEvent)
+		if !ok {
+			return ""
+		}
+		switch order.Status {
+		case "PROCESSED":
+			return WebhookOrderProcessed
+		case "INVALID":
+			return WebhookOrderInvalid
+		}
+	case EventWithdrawalCompleted:
+		return WebhookWithdrawal
+	}
+	return ""
+}
+
+func enqueueWebhooks(handlerVars *HandlerVars, loginID int, eventType string, payload interface{}, data string) {
+	webhookType := webhookEventType(eventType, payload)
+	if webhookType == "" {
+		return
+	}
+	_, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.EnqueueWebhookDeliveries(loginID, webhookType, data))
+	if err != nil {
+		sugar.Errorln("Could not enqueue webhook deliveries. " + err.Error())
+	}
+}
+
+type WebhookPayload struct {
+	DeliveryID int             `json:"delivery_id"`
+	Type       string          `json:"type"`
+	CreatedAt  string          `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// signWebhook подписывает "<timestamp>.<body>": получатель сверяет X-Gophermart-Timestamp с текущим временем
+// и так отбрасывает повторно присланные старые доставки.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sharedAddressSpace — 100.64.0.0/10 (RFC 6598), адреса провайдерского NAT.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP отсекает адреса, по которым вебхук достал бы до внутренней сети сервера:
+// loopback, частные диапазоны, link-local (в том числе 169.254.169.254 метаданных облака) и служебные.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// checkWebhookURL проверяет адрес при регистрации вебхука: все адреса хоста должны быть публичными.
+func checkWebhookURL(ctx context.Context, rawURL string) error {
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Webhook url must be an absolute http or https url.")
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Webhook host could not be resolved.")
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Webhook url must point to a public address.")
+		}
+	}
+	return nil
+}
+
+// webhookDialControl повторяет проверку при каждом соединении: DNS хоста мог измениться после регистрации.
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// newWebhookClient не ходит через прокси и не следует редиректам: иначе адрес назначения ускользает от проверки.
+// Ответ 3xx считается неудачной попыткой.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookRequestTimeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookRequestTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	return webhookBaseBackoff * time.Duration(1<<uint(attempts))
+}
+
+// sendWebhook выполняет одну попытку доставки. Возвращает код ответа, если он был получен.
+func sendWebhook(client *http.Client, delivery *WebhookDelivery) (int, error) {
+	body, err := json.Marshal(&WebhookPayload{
+		DeliveryID: delivery.ID,
+		Type:       delivery.EventType,
+		CreatedAt:  delivery.CreatedAt.Format(time.RFC3339),
+		Data:       json.RawMessage(delivery.Data),
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gophermart-Event", delivery.EventType)
+	req.Header.Set("X-Gophermart-Delivery", strconv.Itoa(delivery.ID))
+	timestamp := time.Now().Unix()
+	req.Header.Set("X-Gophermart-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Gophermart-Signature", signWebhook(delivery.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("unexpected response status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// runWebhookWorker доставляет накопившиеся события, пока не отменён ctx.
+func runWebhookWorker(ctx context.Context, handlerVars *HandlerVars) {
+	client := newWebhookClient()
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetDueWebhookDeliveries(webhookBatchSize))
+			if err != nil {
+				sugar.Errorln(err.Error())
+				continue
+			}
+			for _, delivery := range *obj.(*[]WebhookDelivery) {
+				deliverWebhook(client, &delivery, handlerVars.db)
+			}
+		}
+	}
+}
+
+func deliverWebhook(client *http.Client, delivery *WebhookDelivery, db *DBConnection) {
+	code, err := sendWebhook(client, delivery)
+	status := DeliveryDelivered
+	next := time.Now().UTC()
+	var errText string
+	if err != nil {
+		errText = err.Error()
+		status = DeliveryPending
+		next = next.Add(webhookBackoff(delivery.Attempts))
+		if delivery.Attempts+1 >= webhookMaxAttempts {
+			status = DeliveryFailed
+		}
+		sugar.Infoln("webhook delivery", delivery.ID, "failed:", errText)
+	}
+	_, err = Retrypg(pgerrcode.ConnectionException, db.RecordWebhookAttempt(delivery.ID, code, errText, status, next))
+	if err != nil {
+		sugar.Errorln(err.Error())
+	}
+}
+
+func webhooksPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetWebhooks(user.ID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	webhooks := obj.(*[]WebhookInfo)
+	if len(*webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, webhooks)
+}
+
+type WebhookRequest struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func createWebhookPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, errNotJSON)
+		return
+	}
+
+	var webhook WebhookRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &webhook)
+	if err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	err = checkWebhookURL(r.Context(), webhook.URL)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if len(webhook.Secret) < webhookMinSecretLen {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Webhook secret must be at least "+strconv.Itoa(webhookMinSecretLen)+" characters."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.CreateWebhook(user.ID, webhook.URL, webhook.Secret))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	respJSON, err := json.Marshal(&WebhookInfo{ID: obj.(int), URL: webhook.URL, CreatedAt: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respJSON)
+}
+
+func deleteWebhookPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	webhookID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect webhook id."))
+		return
+	}
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.DeleteWebhook(user.ID, webhookID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Webhook not found."))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func webhookDeliveriesPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	webhookID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect webhook id."))
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryFailed {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "status must be pending, delivered or failed"))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException, handlerVars.db.GetWebhookDeliveries(user.ID, webhookID, status))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	deliveries := obj.(*[]WebhookDeliveryInfo)
+	if len(*deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, deliveries)
+}
+
+func redeliverWebhookPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	handlerVars, ok := r.Context().Value(HandlerVars{}).(*HandlerVars)
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, errInternal)
+		return
+	}
+
+	webhookID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect webhook id."))
+		return
+	}
+	deliveryID, err := strconv.Atoi(ps.ByName("delivery"))
+	if err != nil {
+		writeError(w, NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "Incorrect delivery id."))
+		return
+	}
+
+	obj, err := Retrypg(pgerrcode.ConnectionException,
+		handlerVars.db.RedeliverWebhookDelivery(user.ID, webhookID, deliveryID))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !obj.(bool) {
+		writeError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Delivery not found or already queued."))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
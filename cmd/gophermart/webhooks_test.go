@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{name: "payload", secret: "s3cret", timestamp: 1700000000, body: `{"type":"order"}`,
+			want: "sha256=d5a0b61078e24424d356a711a6196903361f6837551b0a12d1fbd49da8c590dd"},
+		{name: "empty secret and body", secret: "", timestamp: 0, body: "",
+			want: "sha256=b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("signWebhook() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignWebhookCoversTimestamp(t *testing.T) {
+	body := []byte(`{"type":"order"}`)
+	if signWebhook("s3cret", 1700000000, body) == signWebhook("s3cret", 1700000001, body) {
+		t.Error("signWebhook() does not depend on timestamp")
+	}
+	if signWebhook("s3cret", 1700000000, body) == signWebhook("other", 1700000000, body) {
+		t.Error("signWebhook() does not depend on secret")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "8.8.8.8", want: true},
+		{ip: "2001:4860:4860::8888", want: true},
+		{ip: "100.63.255.255", want: true},
+		{ip: "127.0.0.1"},
+		{ip: "::1"},
+		{ip: "10.1.2.3"},
+		{ip: "172.16.0.1"},
+		{ip: "192.168.1.1"},
+		{ip: "fd00::1"},
+		{ip: "169.254.169.254"},
+		{ip: "fe80::1"},
+		{ip: "0.0.0.0"},
+		{ip: "::"},
+		{ip: "224.0.0.1"},
+		{ip: "100.64.0.1"},
+		{ip: "100.127.255.255"},
+		{ip: "::ffff:127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "public ip", url: "https://8.8.8.8/hook"},
+		{name: "public ip with port", url: "http://8.8.8.8:8080/hook"},
+		{name: "ftp scheme", url: "ftp://8.8.8.8/hook", wantErr: true},
+		{name: "relative", url: "/hook", wantErr: true},
+		{name: "no host", url: "http:///hook", wantErr: true},
+		{name: "loopback", url: "http://127.0.0.1/hook", wantErr: true},
+		{name: "ipv6 loopback", url: "http://[::1]:8080/hook", wantErr: true},
+		{name: "metadata", url: "http://169.254.169.254/latest/meta-data", wantErr: true},
+		{name: "private", url: "https://10.0.0.5/hook", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkWebhookURL(context.Background(), tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkWebhookURL(%s) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if err != nil {
+				if apiErr, ok := err.(*APIError); !ok || apiErr.Status != http.StatusBadRequest {
+					t.Errorf("checkWebhookURL(%s) error = %#v, want 400 APIError", tt.url, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	resp, err := newWebhookClient().Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("webhook client connected to a loopback address")
+	}
+	if called {
+		t.Error("loopback server received the request")
+	}
+}